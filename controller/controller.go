@@ -0,0 +1,275 @@
+// Package controller implements the controller mode of the migrator, in which
+// EtcdClusterMigration custom resources declare the desired etcd cluster and
+// a reconciler drives the migrator steps, reporting progress in the status.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	"github.com/giantswarm/etcd-cluster-migrator/migrator"
+)
+
+type Config struct {
+	// DynamicClient is used to access EtcdClusterMigration resources. An
+	// in-cluster client is created when nil.
+	DynamicClient dynamic.Interface
+	Logger        micrologger.Logger
+	// MigratorConfig is the base configuration of the migrators created for
+	// each EtcdClusterMigration. Fields set in the spec take precedence. The
+	// clients and the event recorder are created once when empty and shared
+	// by all migrators.
+	MigratorConfig migrator.MigratorConfig
+	// ResyncInterval is the interval in which all EtcdClusterMigration
+	// resources are reconciled.
+	ResyncInterval time.Duration
+}
+
+type Controller struct {
+	// closeClients closes the clients created for the migrators.
+	closeClients   func()
+	dynamicClient  dynamic.Interface
+	logger         micrologger.Logger
+	migratorConfig migrator.MigratorConfig
+	resyncInterval time.Duration
+}
+
+func New(config Config) (*Controller, error) {
+	if config.Logger == nil {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.Logger must not be empty", config))
+	}
+	if config.ResyncInterval <= 0 {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.ResyncInterval must be greater than zero", config))
+	}
+
+	if config.DynamicClient == nil {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		config.DynamicClient, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+	}
+
+	migratorConfig, closeClients, err := config.MigratorConfig.WithClients()
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	c := &Controller{
+		closeClients:   closeClients,
+		dynamicClient:  config.DynamicClient,
+		logger:         config.Logger,
+		migratorConfig: migratorConfig,
+		resyncInterval: config.ResyncInterval,
+	}
+
+	return c, nil
+}
+
+// Run reconciles all EtcdClusterMigration resources every resync interval
+// until the given context is cancelled and closes the clients of the
+// migrators then.
+func (c *Controller) Run(ctx context.Context) error {
+	defer c.closeClients()
+
+	ticker := time.NewTicker(c.resyncInterval)
+	defer ticker.Stop()
+
+	for {
+		c.reconcileAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Controller) reconcileAll(ctx context.Context) {
+	list, err := c.dynamicClient.Resource(GroupVersionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.logger.Errorf(ctx, err, "failed to list %s resources", Kind)
+		return
+	}
+
+	for _, item := range list.Items {
+		var obj EtcdClusterMigration
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &obj)
+		if err != nil {
+			c.logger.Errorf(ctx, err, "failed to decode %s %s", Kind, item.GetName())
+			continue
+		}
+
+		err = c.reconcile(ctx, &obj)
+		if err != nil {
+			c.logger.Errorf(ctx, err, "failed to reconcile %s %s", Kind, obj.Name)
+		}
+	}
+}
+
+// reconcile runs the migrator for the given EtcdClusterMigration until the
+// migration succeeded or failed, updating the status before every step. A
+// finished migration is only executed again once its spec changed, which
+// makes migrations re-triggerable by updating the resource.
+func (c *Controller) reconcile(ctx context.Context, obj *EtcdClusterMigration) error {
+	finished := obj.Status.Phase == PhaseSucceeded || obj.Status.Phase == PhaseFailed
+	if finished && obj.Status.ObservedGeneration == obj.Generation {
+		return nil
+	}
+
+	c.logger.LogCtx(ctx, "level", "info", "message", "reconciling etcd cluster migration", "migration", obj.Name)
+
+	m, err := migrator.NewMigrator(c.migratorConfigFor(obj.Spec))
+	if err != nil {
+		return c.fail(ctx, obj, "InvalidConfig", err)
+	}
+
+	obj.Status.ObservedGeneration = obj.Generation
+	obj.Status.Phase = PhaseRunning
+	setCondition(obj, ConditionProgressing, metav1.ConditionTrue, "MigrationRunning", "etcd cluster migration is running")
+	setCondition(obj, ConditionReady, metav1.ConditionFalse, "MigrationRunning", "etcd cluster migration is running")
+
+	// failing to report the progress stops the migration, which is retried
+	// on the next resync instead of being marked as failed
+	var progressErr error
+	progress := func(ctx context.Context) error {
+		progressErr = c.updateProgress(ctx, m, obj)
+		return progressErr
+	}
+
+	err = m.RunWithProgress(ctx, progress)
+	if progressErr != nil {
+		return microerror.Mask(progressErr)
+	} else if migrator.IsLockHeld(err) {
+		// the migration is retried on the next resync when another
+		// migrator holds the lock
+		return microerror.Mask(err)
+	} else if err != nil {
+		obj.Status.MigrationPhase, obj.Status.Node = m.Phase()
+		return c.fail(ctx, obj, "StepFailed", err)
+	}
+
+	err = c.updateMembers(ctx, m, obj)
+	if err != nil {
+		return c.fail(ctx, obj, "StatusFailed", err)
+	}
+	obj.Status.Phase = PhaseSucceeded
+	setCondition(obj, ConditionProgressing, metav1.ConditionFalse, "MigrationSucceeded", "etcd cluster migration successfully finished")
+	setCondition(obj, ConditionReady, metav1.ConditionTrue, "MigrationSucceeded", "etcd cluster migration successfully finished")
+
+	err = c.updateStatus(ctx, obj)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	c.logger.LogCtx(ctx, "level", "info", "message", "etcd cluster migration successfully finished", "migration", obj.Name)
+
+	return nil
+}
+
+// updateProgress reports the members and the phase of the given migrator in
+// the status.
+func (c *Controller) updateProgress(ctx context.Context, m *migrator.Migrator, obj *EtcdClusterMigration) error {
+	err := c.updateMembers(ctx, m, obj)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	err = c.updateStatus(ctx, obj)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// fail marks the migration as failed and returns the given error.
+func (c *Controller) fail(ctx context.Context, obj *EtcdClusterMigration, reason string, err error) error {
+	obj.Status.ObservedGeneration = obj.Generation
+	obj.Status.Phase = PhaseFailed
+	setCondition(obj, ConditionProgressing, metav1.ConditionFalse, reason, err.Error())
+	setCondition(obj, ConditionReady, metav1.ConditionFalse, reason, err.Error())
+
+	updateErr := c.updateStatus(ctx, obj)
+	if updateErr != nil {
+		c.logger.Errorf(ctx, updateErr, "failed to update status of %s %s", Kind, obj.Name)
+	}
+
+	return microerror.Mask(err)
+}
+
+func (c *Controller) migratorConfigFor(spec EtcdClusterMigrationSpec) migrator.MigratorConfig {
+	config := c.migratorConfig
+	config.Logger = c.logger
+	config.BaseDomain = spec.BaseDomain
+	config.MemberCount = spec.MemberCount
+	if spec.EtcdStartingIndex != 0 {
+		config.EtcdStartingIndex = spec.EtcdStartingIndex
+	}
+	if spec.MasterNodeLabel != "" {
+		config.MasterNodeLabels = []string{spec.MasterNodeLabel}
+	}
+
+	return config
+}
+
+func (c *Controller) updateMembers(ctx context.Context, m *migrator.Migrator, obj *EtcdClusterMigration) error {
+	s, err := m.Status(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	var members []EtcdMemberStatus
+	for _, member := range s.Members {
+		members = append(members, EtcdMemberStatus{
+			ID:       fmt.Sprintf("%x", member.ID),
+			Name:     member.Name,
+			NodeName: member.NodeName,
+			PeerURLs: member.PeerURLs,
+			Started:  member.Started,
+		})
+	}
+	obj.Status.Members = members
+	obj.Status.MigrationPhase, obj.Status.Node = m.Phase()
+
+	return nil
+}
+
+func (c *Controller) updateStatus(ctx context.Context, obj *EtcdClusterMigration) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	updated, err := c.dynamicClient.Resource(GroupVersionResource).UpdateStatus(ctx, &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	obj.ResourceVersion = updated.GetResourceVersion()
+
+	return nil
+}
+
+func setCondition(obj *EtcdClusterMigration, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(&obj.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: obj.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/giantswarm/etcd-cluster-migrator/migrator"
+)
+
+const testBaseDomain = "cluster.test"
+
+// testEtcdClient lists the given members. The migrator only needs the
+// membership to find out there is nothing left to do or that the etcd
+// cluster is unexpected.
+type testEtcdClient struct {
+	etcdclientv3.Cluster
+	etcdclientv3.Maintenance
+
+	members []*etcdserver.Member
+}
+
+func (c *testEtcdClient) MemberList(ctx context.Context) (*etcdclientv3.MemberListResponse, error) {
+	return &etcdclientv3.MemberListResponse{
+		Header:  &etcdserver.ResponseHeader{ClusterId: 1},
+		Members: c.members,
+	}, nil
+}
+
+func (c *testEtcdClient) Compact(ctx context.Context, rev int64, opts ...etcdclientv3.CompactOption) (*etcdclientv3.CompactResponse, error) {
+	return &etcdclientv3.CompactResponse{}, nil
+}
+
+func (c *testEtcdClient) Close() error {
+	return nil
+}
+
+func (c *testEtcdClient) Endpoints() []string {
+	return []string{"https://127.0.0.1:2379"}
+}
+
+// testMembers returns the given number of started members.
+func testMembers(count int) []*etcdserver.Member {
+	var members []*etcdserver.Member
+	for i := 1; i <= count; i++ {
+		members = append(members, &etcdserver.Member{
+			ID:       uint64(i),
+			Name:     fmt.Sprintf("etcd%d", i),
+			PeerURLs: []string{fmt.Sprintf("https://etcd%d.%s:2380", i, testBaseDomain)},
+		})
+	}
+
+	return members
+}
+
+func Test_Controller_reconcile(t *testing.T) {
+	testCases := []struct {
+		name            string
+		members         int
+		expectedPhase   string
+		expectedError   bool
+		expectedMembers int
+		expectedEvent   string
+	}{
+		{
+			name:            "case 0: migration of a complete etcd cluster succeeds",
+			members:         3,
+			expectedPhase:   PhaseSucceeded,
+			expectedMembers: 3,
+			expectedEvent:   "Normal EtcdMigrationSucceeded",
+		},
+		{
+			name:            "case 1: migration of an etcd cluster with too many members fails",
+			members:         4,
+			expectedPhase:   PhaseFailed,
+			expectedError:   true,
+			expectedMembers: 4,
+			expectedEvent:   "Warning EtcdMigrationFailed",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+
+			k8sClient := fake.NewSimpleClientset()
+			for n := 1; n <= 3; n++ {
+				node := &apiv1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: fmt.Sprintf("master-%d", n),
+						Labels: map[string]string{
+							"role":                    "master",
+							"giantswarm.io/master-id": strconv.Itoa(n),
+						},
+					},
+					Status: apiv1.NodeStatus{
+						Conditions: []apiv1.NodeCondition{
+							{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue},
+						},
+					},
+				}
+				_, err := k8sClient.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("expected nil got %#v", err)
+				}
+			}
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "etcd-cluster-migrator",
+					Namespace: "kube-system",
+				},
+			}
+			_, err := k8sClient.BatchV1().Jobs(job.Namespace).Create(ctx, job, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+
+			obj := &EtcdClusterMigration{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: Group + "/" + Version,
+					Kind:       Kind,
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "migration",
+					Generation: 1,
+				},
+				Spec: EtcdClusterMigrationSpec{
+					BaseDomain:  testBaseDomain,
+					MemberCount: 3,
+				},
+			}
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+			dynamicClient := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{GroupVersionResource: Kind + "List"}, &unstructured.Unstructured{Object: content})
+
+			recorder := record.NewFakeRecorder(100)
+			c, err := New(Config{
+				DynamicClient: dynamicClient,
+				Logger:        microloggertest.New(),
+				MigratorConfig: migrator.MigratorConfig{
+					EtcdClient:        &testEtcdClient{members: testMembers(tc.members)},
+					EventRecorder:     recorder,
+					K8sClient:         k8sClient,
+					DockerRegistry:    "quay.io",
+					EtcdStartingIndex: 1,
+					JobName:           job.Name,
+					JobNamespace:      job.Namespace,
+					MasterNodeLabels:  []string{"role=master"},
+				},
+				ResyncInterval: time.Minute,
+			})
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+
+			reconciling := *obj
+			err = c.reconcile(ctx, &reconciling)
+			switch {
+			case err == nil && !tc.expectedError:
+				// correct; carry on
+			case err != nil && !tc.expectedError:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.expectedError:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			}
+
+			item, err := dynamicClient.Resource(GroupVersionResource).Get(ctx, obj.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+			var reconciled EtcdClusterMigration
+			err = runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &reconciled)
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+
+			if reconciled.Status.Phase != tc.expectedPhase {
+				t.Fatalf("%s: expected phase %s got %#v", tc.name, tc.expectedPhase, reconciled.Status)
+			}
+			if reconciled.Status.ObservedGeneration != obj.Generation {
+				t.Fatalf("%s: expected observed generation %d got %d", tc.name, obj.Generation, reconciled.Status.ObservedGeneration)
+			}
+			if len(reconciled.Status.Members) != tc.expectedMembers {
+				t.Fatalf("%s: expected %d members got %#v", tc.name, tc.expectedMembers, reconciled.Status.Members)
+			}
+			if reconciled.Status.MigrationPhase == "" {
+				t.Fatalf("%s: expected migration phase got %#v", tc.name, reconciled.Status)
+			}
+
+			// the migration state and the job events are kept in the
+			// controller mode
+			_, err = k8sClient.CoreV1().ConfigMaps("kube-system").Get(ctx, "etcd-cluster-migrator-state", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("%s: expected migration state got %#v", tc.name, err)
+			}
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			var found bool
+			for _, e := range events {
+				if strings.HasPrefix(e, tc.expectedEvent) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s: expected event %s got %v", tc.name, tc.expectedEvent, events)
+			}
+
+			// a finished migration is not executed again
+			c.reconcileAll(ctx)
+			if len(recorder.Events) != 0 {
+				t.Fatalf("%s: expected no events got %d", tc.name, len(recorder.Events))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group    = "etcd.giantswarm.io"
+	Version  = "v1alpha1"
+	Kind     = "EtcdClusterMigration"
+	Resource = "etcdclustermigrations"
+)
+
+// GroupVersionResource identifies the EtcdClusterMigration custom resource.
+var GroupVersionResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  Version,
+	Resource: Resource,
+}
+
+const (
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+
+	ConditionProgressing = "Progressing"
+	ConditionReady       = "Ready"
+)
+
+// EtcdClusterMigration declares the desired etcd cluster the migrator should
+// grow the single member etcd cluster into.
+type EtcdClusterMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdClusterMigrationSpec   `json:"spec"`
+	Status EtcdClusterMigrationStatus `json:"status,omitempty"`
+}
+
+type EtcdClusterMigrationSpec struct {
+	// BaseDomain is used for the etcd DNS addresses of the members.
+	BaseDomain string `json:"baseDomain"`
+	// EtcdStartingIndex is the index of the first etcd DNS address.
+	// Defaults to 1.
+	EtcdStartingIndex int `json:"etcdStartingIndex,omitempty"`
+	// MasterNodeLabel is the label selector matching all master nodes.
+	// Defaults to the controller configuration.
+	MasterNodeLabel string `json:"masterNodeLabel,omitempty"`
+	// MemberCount is the desired number of etcd members.
+	MemberCount int `json:"memberCount"`
+}
+
+type EtcdClusterMigrationStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	Members    []EtcdMemberStatus `json:"members,omitempty"`
+	// MigrationPhase is the phase the migrator is in, or stopped in, e.g.
+	// configure-node.
+	MigrationPhase string `json:"migrationPhase,omitempty"`
+	// Node is the node the migration phase is executed for, if any.
+	Node               string `json:"node,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	Phase              string `json:"phase,omitempty"`
+}
+
+type EtcdMemberStatus struct {
+	// ID is the hex encoded etcd member ID.
+	ID       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	NodeName string   `json:"nodeName,omitempty"`
+	PeerURLs []string `json:"peerURLs,omitempty"`
+	Started  bool     `json:"started"`
+}
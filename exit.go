@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"github.com/giantswarm/microerror"
+
+	"github.com/giantswarm/etcd-cluster-migrator/controller"
+	"github.com/giantswarm/etcd-cluster-migrator/migrator"
+	"github.com/giantswarm/etcd-cluster-migrator/pkg/logger"
+)
+
+// Exit codes of the migrator process. They are part of the public interface
+// and documented in the README, so released values must not change. Go exits
+// with 2 on a panic, so no error class uses it. Invalid configuration exits
+// with 64, EX_USAGE of sysexits.h, instead of a code in the 1-10 range, so
+// that it is told apart from a failed migration the same way other tools do.
+const (
+	exitCodeUnknown           = 1
+	exitCodeInvalidConfig     = 64
+	exitCodeExecutionFailed   = 3
+	exitCodePreflightFailed   = 4
+	exitCodeQuorumRisk        = 5
+	exitCodeTimeout           = 6
+	exitCodeRollbackPerformed = 7
+	exitCodeInterrupted       = 8
+	exitCodeLockHeld          = 9
+	exitCodeQuorumLost        = 10
+
+	// maxTerminationMessageLength is the maximum size Kubernetes reads from
+	// the termination message file.
+	maxTerminationMessageLength = 4096
+)
+
+// errorSummary is the machine-readable description of a failed run.
+type errorSummary struct {
+	Class    string `json:"class"`
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message"`
+}
+
+func newErrorSummary(err error) errorSummary {
+	s := errorSummary{
+		Message: err.Error(),
+	}
+
+	switch {
+	case migrator.IsInvalidConfig(err), controller.IsInvalidConfig(err), logger.IsInvalidConfig(err), IsInvalidFlag(err):
+		s.Class, s.ExitCode = "invalidConfig", exitCodeInvalidConfig
+	case migrator.IsExecutionFailed(err):
+		s.Class, s.ExitCode = "executionFailed", exitCodeExecutionFailed
+	case migrator.IsPreflightFailed(err):
+		s.Class, s.ExitCode = "preflightFailed", exitCodePreflightFailed
+	case migrator.IsQuorumLost(err):
+		s.Class, s.ExitCode = "quorumLost", exitCodeQuorumLost
+	case migrator.IsQuorumRisk(err):
+		s.Class, s.ExitCode = "quorumRisk", exitCodeQuorumRisk
+	case migrator.IsTimeout(err), errors.Is(microerror.Cause(err), context.DeadlineExceeded):
+		s.Class, s.ExitCode = "timeout", exitCodeTimeout
+	case migrator.IsRollbackPerformed(err):
+		s.Class, s.ExitCode = "rollbackPerformed", exitCodeRollbackPerformed
+	case migrator.IsLockHeld(err):
+		s.Class, s.ExitCode = "lockHeld", exitCodeLockHeld
+	case errors.Is(microerror.Cause(err), context.Canceled):
+		s.Class, s.ExitCode = "interrupted", exitCodeInterrupted
+	default:
+		s.Class, s.ExitCode = "unknown", exitCodeUnknown
+	}
+
+	return s
+}
+
+// reportError writes the error summary to stdout and the termination message
+// file as configured and returns the exit code for the given error.
+func reportError(f Flag, err error) int {
+	s := newErrorSummary(err)
+
+	b, marshalErr := json.Marshal(s)
+	if marshalErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal error summary: %s\n", marshalErr)
+		return s.ExitCode
+	}
+
+	if f.ErrorSummary {
+		fmt.Fprintln(os.Stdout, string(b))
+	} else {
+		fmt.Fprintln(os.Stderr, microerror.Pretty(err, true))
+	}
+
+	if f.TerminationMessagePath != "" {
+		writeErr := os.WriteFile(f.TerminationMessagePath, terminationMessage(s), 0600)
+		if writeErr != nil {
+			fmt.Fprintf(os.Stderr, "failed to write termination message to %s: %s\n", f.TerminationMessagePath, writeErr)
+		}
+	}
+
+	return s.ExitCode
+}
+
+// terminationMessage returns the JSON encoded summary with its message
+// shortened so that it fits into the termination message. The message is
+// cut on a rune boundary, as a split character would be encoded as a
+// replacement character.
+func terminationMessage(s errorSummary) []byte {
+	b, _ := json.Marshal(s)
+	for len(b) > maxTerminationMessageLength && s.Message != "" {
+		n := len(s.Message) - (len(b) - maxTerminationMessageLength)
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(s.Message[n]) {
+			n--
+		}
+		s.Message = s.Message[:n]
+		b, _ = json.Marshal(s)
+	}
+
+	return b
+}
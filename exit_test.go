@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/microerror"
+)
+
+func Test_newErrorSummary(t *testing.T) {
+	testCases := []struct {
+		name             string
+		err              error
+		expectedClass    string
+		expectedExitCode int
+	}{
+		{
+			name:             "case 0: invalid flag",
+			err:              microerror.Maskf(invalidFlagError, "--mode must be one of"),
+			expectedClass:    "invalidConfig",
+			expectedExitCode: exitCodeInvalidConfig,
+		},
+		{
+			name:             "case 1: cancelled context",
+			err:              microerror.Mask(context.Canceled),
+			expectedClass:    "interrupted",
+			expectedExitCode: exitCodeInterrupted,
+		},
+		{
+			name:             "case 2: exceeded deadline",
+			err:              microerror.Mask(context.DeadlineExceeded),
+			expectedClass:    "timeout",
+			expectedExitCode: exitCodeTimeout,
+		},
+		{
+			name:             "case 3: unknown error",
+			err:              microerror.Mask(&microerror.Error{Kind: "testError"}),
+			expectedClass:    "unknown",
+			expectedExitCode: exitCodeUnknown,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			s := newErrorSummary(tc.err)
+
+			if s.Class != tc.expectedClass {
+				t.Fatalf("%s: expected class %q got %q", tc.name, tc.expectedClass, s.Class)
+			}
+			if s.ExitCode != tc.expectedExitCode {
+				t.Fatalf("%s: expected exit code %d got %d", tc.name, tc.expectedExitCode, s.ExitCode)
+			}
+		})
+	}
+}
+
+func Test_terminationMessage(t *testing.T) {
+	s := errorSummary{
+		Class:    "executionFailed",
+		ExitCode: exitCodeExecutionFailed,
+		Message:  strings.Repeat("ü", maxTerminationMessageLength),
+	}
+
+	b := terminationMessage(s)
+	if len(b) > maxTerminationMessageLength {
+		t.Fatalf("expected at most %d bytes got %d", maxTerminationMessageLength, len(b))
+	}
+
+	var decoded errorSummary
+	err := json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if decoded.Message == "" || strings.Trim(decoded.Message, "ü") != "" {
+		t.Fatalf("expected message cut on a rune boundary got %q", decoded.Message)
+	}
+}
@@ -1,46 +1,146 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	flag "github.com/spf13/pflag"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 
+	"github.com/giantswarm/etcd-cluster-migrator/controller"
 	"github.com/giantswarm/etcd-cluster-migrator/migrator"
+	"github.com/giantswarm/etcd-cluster-migrator/pkg/logger"
 	"github.com/giantswarm/etcd-cluster-migrator/pkg/project"
 )
 
 type Flag struct {
-	BaseDomain        string
-	DockerRegistry    string
-	EtcdCaFile        string
-	EtcdCertFile      string
-	EtcdEndpoint      string
-	EtcdKeyFile       string
-	EtcdStartingIndex int
-	MasterNodesLabel  string
+	Action                      string
+	BaseDomain                  string
+	ClockSkewLimit              time.Duration
+	ClockSkewWarning            time.Duration
+	CommandBackoffLimit         int32
+	CommandCPU                  string
+	CommandDeadline             time.Duration
+	CommandImage                string
+	CommandImageDigest          string
+	CommandImagePullSecrets     []string
+	CommandMemory               string
+	CommandNamespace            string
+	CommandPodTemplateConfigMap string
+	CommandPodTemplateFile      string
+	CommandPriorityClass        string
+	CommandServiceAccount       string
+	CompactRetention            int64
+	Defragment                  bool
+	DiskSpaceFactor             float64
+	DockerRegistry              string
+	EtcdCaFile                  string
+	EtcdCaKeyFile               string
+	EtcdCaKeySecret             string
+	EtcdCertFile                string
+	EtcdEndpoint                string
+	EtcdKeyFile                 string
+	EtcdStartingIndex           int
+	ErrorSummary                bool
+	FsyncLatencyLimit           time.Duration
+	JobName                     string
+	JobNamespace                string
+	LogFormat                   string
+	ManageHostsFile             bool
+	MasterIDLabel               string
+	MasterNodeLabels            []string
+	MemberCount                 int
+	MemberNodes                 map[string]string
+	MetricsAddress              string
+	Mode                        string
+	NodeCertFiles               []string
+	NodeOrder                   []string
+	PushgatewayURL              string
+	Recovery                    string
+	RecoveryConfirm             string
+	ResyncInterval              time.Duration
+	SkipVersionCheck            bool
+	TerminationMessagePath      string
 }
 
+const (
+	modeController = "controller"
+	modeJob        = "job"
+
+	actionCleanupBackups = "cleanup-backups"
+	actionMigrate        = "migrate"
+	actionRemoveHosts    = "remove-hosts"
+)
+
 func main() {
-	err := mainError()
+	var f Flag
+	err := mainError(&f)
 	if err != nil {
-		panic(fmt.Sprintf("%#v", err))
+		os.Exit(reportError(f, err))
 	}
 }
 
-func mainError() error {
+func mainError(f *Flag) error {
 	var err error
 
-	var f Flag
+	flag.StringVar(&f.Action, "action", actionMigrate, fmt.Sprintf("Action executed in job mode, either %s to migrate the etcd cluster, %s to remove the etcd backups taken on the nodes once the migration is verified, or %s to remove the etcd peer hosts installed with --manage-hosts-file.", actionMigrate, actionCleanupBackups, actionRemoveHosts))
 	flag.StringVar(&f.BaseDomain, "base-domain", "abcde.k8s.ginger.eu-west-1.aws.gigantic.io", "Base domain that is used for the etcd DNS address.")
+	flag.DurationVar(&f.ClockSkewLimit, "clock-skew-limit", time.Second, "Offset of a master node clock from NTP time, or from the migrator clock when the node reports none, above which the migration does not start. A negative value disables the check.")
+	flag.DurationVar(&f.ClockSkewWarning, "clock-skew-warning", time.Millisecond*500, "Offset of a master node clock from NTP time, or from the migrator clock when the node reports none, above which a warning is logged.")
+	flag.Int32Var(&f.CommandBackoffLimit, "command-backoff-limit", 10, "Number of retries of the run-command Job pods.")
+	flag.StringVar(&f.CommandCPU, "command-cpu", "50m", "CPU request and limit of the run-command Job pods.")
+	flag.DurationVar(&f.CommandDeadline, "command-deadline", time.Second*240, "Time a run-command Job may run before it is recreated.")
+	flag.StringVar(&f.CommandImage, "command-image", "", "Full image reference of the run-command Job pods. Defaults to giantswarm/alpine in --docker-registry.")
+	flag.StringVar(&f.CommandImageDigest, "command-image-digest", "", "Digest pinning the run-command image, e.g. sha256:abc...")
+	flag.StringArrayVar(&f.CommandImagePullSecrets, "command-image-pull-secret", nil, "Image pull secret of the run-command Job pods, can be given multiple times.")
+	flag.StringVar(&f.CommandMemory, "command-memory", "50Mi", "Memory request and limit of the run-command Job pods.")
+	flag.StringVar(&f.CommandNamespace, "command-namespace", "kube-system", "Namespace the run-command Jobs, the migration lock and the migration state are created in. All migrators of a cluster must use the same namespace.")
+	flag.StringVar(&f.CommandPodTemplateConfigMap, "command-pod-template-configmap", "", "ConfigMap in --command-namespace with a pod template in its podTemplate key, merged into the run-command Job pods.")
+	flag.StringVar(&f.CommandPodTemplateFile, "command-pod-template-file", "", "File with a pod template in YAML merged into the run-command Job pods.")
+	flag.StringVar(&f.CommandPriorityClass, "command-priority-class", "system-cluster-critical", "Priority class of the run-command Job pods.")
+	flag.StringVar(&f.CommandServiceAccount, "command-service-account", "etcd-cluster-migrator-cmd", "Service account of the run-command Job pods.")
+	flag.Int64Var(&f.CompactRetention, "compact-retention", 1000, "Number of revisions kept when the etcd history is compacted with --defragment. A negative value defragments without compacting.")
+	flag.BoolVar(&f.Defragment, "defragment", false, "Compact the etcd history and defragment the database of the single member before the first member gets added, clearing a NOSPACE alarm.")
+	flag.Float64Var(&f.DiskSpaceFactor, "disk-space-factor", 2, "Multiple of the etcd database size which must be free in the etcd data directory of a node before its member gets added. A negative value disables the check.")
 	flag.StringVar(&f.DockerRegistry, "docker-registry", "quay.io", "Docker registry for the run command container.")
 	flag.StringVar(&f.EtcdCaFile, "etcd-ca-file", "/etc/kubernetes/ssl/etcd/server-ca.pem", "Filepath to the etcd CA file.")
+	flag.StringVar(&f.EtcdCaKeyFile, "etcd-ca-key-file", "", "Filepath to the private key of the etcd CA. When set, etcd peer and server certificates are issued for every added member.")
+	flag.StringVar(&f.EtcdCaKeySecret, "etcd-ca-key-secret", "", "Secret given as namespace/name holding the private key of the etcd CA in its tls.key entry. When set, etcd peer and server certificates are issued for every added member.")
 	flag.StringVar(&f.EtcdCertFile, "etcd-crt-file", "/etc/kubernetes/ssl/etcd/server-crt.pem", "Filepath to the etcd certificate file.")
 	flag.StringVar(&f.EtcdEndpoint, "etcd-endpoint", "127.0.0.1:2379", "Etcd endpoint for connection to the etcd server.")
 	flag.StringVar(&f.EtcdKeyFile, "etcd-key-file", "/etc/kubernetes/ssl/etcd/server-key.pem", "Filepath to the etcd private key file.")
 	flag.IntVar(&f.EtcdStartingIndex, "etcd-starting-index", 1, "Starting index for the etcd DNS address.")
-	flag.StringVar(&f.MasterNodesLabel, "master-node-label", "role=master", "Label selector to match against all master nodes.")
+	flag.BoolVar(&f.ErrorSummary, "error-summary", false, "Print a JSON error summary to stdout when the migration fails.")
+	flag.DurationVar(&f.FsyncLatencyLimit, "fsync-latency-limit", time.Millisecond*10, "99th percentile of the fsync latency of the etcd data directory of a node above which its member is not added. A negative value disables the check.")
+	flag.StringVar(&f.JobName, "job-name", "", "Name of the Job the migrator runs in, used to record events against it.")
+	flag.StringVar(&f.JobNamespace, "job-namespace", "", "Namespace of the Job the migrator runs in.")
+	flag.StringVar(&f.LogFormat, "log-format", logger.FormatJSON, "Log output format, either json or text.")
+	flag.BoolVar(&f.ManageHostsFile, "manage-hosts-file", false, "Install the etcd peer hosts of all planned members into /etc/hosts on every master node, for environments without DNS records for them.")
+	flag.StringVar(&f.MasterIDLabel, "master-id-label", "giantswarm.io/master-id", "Key of the numeric node label ordering the master nodes.")
+	flag.StringArrayVar(&f.MasterNodeLabels, "master-node-label", nil, "Label selector to match against all master nodes, can be given multiple times. Defaults to detecting the node-role.kubernetes.io/control-plane, node-role.kubernetes.io/master and role=master labels.")
+	flag.IntVar(&f.MemberCount, "member-count", 3, "Desired number of etcd members.")
+	flag.StringToStringVar(&f.MemberNodes, "member-nodes", nil, "Comma separated etcd member indexes mapped to the master nodes running them, e.g. 1=nodeA,3=nodeC. Unmapped members run on the remaining eligible master nodes.")
+	flag.StringVar(&f.MetricsAddress, "metrics-address", "", "Address to serve Prometheus metrics on /metrics, e.g. :8000. Disabled when empty.")
+	flag.StringVar(&f.Mode, "mode", modeJob, "Either job to run a single migration, or controller to reconcile EtcdClusterMigration resources.")
+	flag.StringArrayVar(&f.NodeCertFiles, "node-cert-file", nil, "Path of an etcd server or peer certificate on the master nodes, verified before a node joins the etcd cluster, can be given multiple times. Defaults to /etc/kubernetes/ssl/etcd/server-crt.pem.")
+	flag.StringSliceVar(&f.NodeOrder, "node-order", nil, "Comma separated master node names in the order they become etcd members, e.g. nodeA,nodeB,nodeC. Overrides --master-id-label.")
+	flag.StringVar(&f.PushgatewayURL, "pushgateway-url", "", "URL of a Prometheus Pushgateway to push metrics to when the migration finishes. Disabled when empty.")
+	flag.StringVar(&f.Recovery, "recovery", "", fmt.Sprintf("Recovery executed when the etcd cluster lost quorum because an added member did not start, either %s or %s. Disabled when empty.", migrator.RecoveryRetryNode, migrator.RecoveryForceNewCluster))
+	flag.StringVar(&f.RecoveryConfirm, "recovery-confirm", "", fmt.Sprintf("Must be set to the base domain to confirm --recovery=%s, which drops all etcd members but the first one.", migrator.RecoveryForceNewCluster))
+	flag.DurationVar(&f.ResyncInterval, "resync-interval", time.Minute, "Interval in which EtcdClusterMigration resources are reconciled in controller mode.")
+	flag.BoolVar(&f.SkipVersionCheck, "skip-version-check", false, "Do not compare the etcd version of the nodes about to join with the version of the etcd cluster.")
+	flag.StringVar(&f.TerminationMessagePath, "termination-message-path", "", "File the JSON error summary is written to when the migration fails, e.g. /dev/termination-log. Disabled when empty.")
 
 	if len(os.Args) > 1 && os.Args[1] == "version" {
 		fmt.Printf("%s:%s - %s", project.Name(), project.Version(), project.GitSHA())
@@ -52,30 +152,248 @@ func mainError() error {
 	}
 	flag.Parse()
 
-	var m *migrator.Migrator
+	var l micrologger.Logger
 	{
-		c := migrator.MigratorConfig{
-			BaseDomain:        f.BaseDomain,
-			DockerRegistry:    f.DockerRegistry,
-			EtcdCaFile:        f.EtcdCaFile,
-			EtcdCertFile:      f.EtcdCertFile,
-			EtcdEndpoint:      f.EtcdEndpoint,
-			EtcdKeyFile:       f.EtcdKeyFile,
-			EtcdStartingIndex: f.EtcdStartingIndex,
-			MasterNodeLabel:   f.MasterNodesLabel,
+		c := logger.Config{
+			Format: f.LogFormat,
 		}
 
-		m, err = migrator.NewMigrator(c)
+		l, err = logger.New(c)
 		if err != nil {
 			return microerror.Mask(err)
 		}
 	}
 
-	err = m.Run()
+	memberNodes, err := parseMemberNodes(f.MemberNodes)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	commandJob, err := commandJobConfig(f)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	if f.MetricsAddress != "" {
+		go serveMetrics(l, f.MetricsAddress)
+	}
+
+	migratorConfig := migrator.MigratorConfig{
+		BaseDomain:        f.BaseDomain,
+		ClockSkewLimit:    f.ClockSkewLimit,
+		ClockSkewWarning:  f.ClockSkewWarning,
+		CommandJob:        commandJob,
+		CompactRetention:  f.CompactRetention,
+		Defragment:        f.Defragment,
+		DiskSpaceFactor:   f.DiskSpaceFactor,
+		DockerRegistry:    f.DockerRegistry,
+		EtcdCaFile:        f.EtcdCaFile,
+		EtcdCaKeyFile:     f.EtcdCaKeyFile,
+		EtcdCaKeySecret:   f.EtcdCaKeySecret,
+		EtcdCertFile:      f.EtcdCertFile,
+		EtcdEndpoint:      f.EtcdEndpoint,
+		EtcdKeyFile:       f.EtcdKeyFile,
+		EtcdStartingIndex: f.EtcdStartingIndex,
+		FsyncLatencyLimit: f.FsyncLatencyLimit,
+		JobName:           f.JobName,
+		JobNamespace:      f.JobNamespace,
+		Logger:            l,
+		ManageHostsFile:   f.ManageHostsFile,
+		MasterIDLabel:     f.MasterIDLabel,
+		MasterNodeLabels:  f.MasterNodeLabels,
+		MemberCount:       f.MemberCount,
+		MemberNodes:       memberNodes,
+		NodeCertFiles:     f.NodeCertFiles,
+		NodeOrder:         f.NodeOrder,
+		SkipVersionCheck:  f.SkipVersionCheck,
+
+		Recovery:             f.Recovery,
+		RecoveryConfirmation: f.RecoveryConfirm,
+	}
+
+	// the context is cancelled on the first SIGTERM or SIGINT so the migrator
+	// can safely abort, a second signal terminates the process immediately
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	switch f.Mode {
+	case modeController:
+		if f.Action != actionMigrate {
+			return microerror.Maskf(invalidFlagError, "--action=%s is only supported with --mode=%s", f.Action, modeJob)
+		}
+		return runController(ctx, l, migratorConfig, f.ResyncInterval)
+	case modeJob:
+		if f.Action == actionCleanupBackups {
+			return runCleanupBackups(ctx, migratorConfig)
+		} else if f.Action == actionRemoveHosts {
+			return runRemoveHosts(ctx, migratorConfig)
+		} else if f.Action != actionMigrate {
+			return microerror.Maskf(invalidFlagError, "--action must be one of %q, %q or %q, got %q", actionMigrate, actionCleanupBackups, actionRemoveHosts, f.Action)
+		}
+		return runJob(ctx, l, migratorConfig, f.PushgatewayURL)
+	default:
+		return microerror.Maskf(invalidFlagError, "--mode must be one of %q or %q, got %q", modeController, modeJob, f.Mode)
+	}
+}
+
+func runController(ctx context.Context, l micrologger.Logger, migratorConfig migrator.MigratorConfig, resyncInterval time.Duration) error {
+	c := controller.Config{
+		Logger:         l,
+		MigratorConfig: migratorConfig,
+		ResyncInterval: resyncInterval,
+	}
+
+	ctrl, err := controller.New(c)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	err = ctrl.Run(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+func runJob(ctx context.Context, l micrologger.Logger, migratorConfig migrator.MigratorConfig, pushgatewayURL string) error {
+	m, err := migrator.NewMigrator(migratorConfig)
+	if err != nil {
+		// a configuration failure is reported like a failed migration
+		migrator.ObserveResult(err)
+		pushMetrics(ctx, l, pushgatewayURL)
+		return microerror.Mask(err)
+	}
+
+	err = m.Run(ctx)
+	pushMetrics(ctx, l, pushgatewayURL)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// pushMetrics pushes the migration metrics to the Pushgateway at the given
+// URL, if any.
+func pushMetrics(ctx context.Context, l micrologger.Logger, pushgatewayURL string) {
+	if pushgatewayURL == "" {
+		return
+	}
+
+	err := push.New(pushgatewayURL, project.Name()).Gatherer(migrator.Gatherer()).Push()
+	if err != nil {
+		l.Errorf(ctx, err, "failed to push metrics to %s", pushgatewayURL)
+	}
+}
+
+func runCleanupBackups(ctx context.Context, migratorConfig migrator.MigratorConfig) error {
+	m, err := migrator.NewMigrator(migratorConfig)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	err = m.CleanupBackups(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+func runRemoveHosts(ctx context.Context, migratorConfig migrator.MigratorConfig) error {
+	m, err := migrator.NewMigrator(migratorConfig)
+	if err != nil {
+		return microerror.Mask(err)
+	}
 
+	err = m.RemoveHostsEntries(ctx)
 	if err != nil {
 		return microerror.Mask(err)
 	}
 
 	return nil
 }
+
+func serveMetrics(l micrologger.Logger, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	s := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err := s.ListenAndServe()
+	if err != nil {
+		l.Errorf(context.Background(), err, "failed to serve metrics on %s", address)
+	}
+}
+
+// parseMemberNodes converts the --member-nodes flag into a mapping of etcd
+// member indexes to node names.
+func parseMemberNodes(flagValue map[string]string) (map[int]string, error) {
+	memberNodes := map[int]string{}
+	for key, name := range flagValue {
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, microerror.Maskf(invalidFlagError, "--member-nodes must map numeric etcd member indexes to node names, got %q", key)
+		}
+		memberNodes[index] = name
+	}
+
+	return memberNodes, nil
+}
+
+// commandJobConfig converts the --command-* flags into the configuration of
+// the run-command Jobs.
+func commandJobConfig(f *Flag) (migrator.CommandJobConfig, error) {
+	cpu, err := resource.ParseQuantity(f.CommandCPU)
+	if err != nil {
+		return migrator.CommandJobConfig{}, microerror.Maskf(invalidFlagError, "--command-cpu must be a resource quantity, got %q", f.CommandCPU)
+	}
+	memory, err := resource.ParseQuantity(f.CommandMemory)
+	if err != nil {
+		return migrator.CommandJobConfig{}, microerror.Maskf(invalidFlagError, "--command-memory must be a resource quantity, got %q", f.CommandMemory)
+	}
+
+	c := migrator.CommandJobConfig{
+		ActiveDeadline:       f.CommandDeadline,
+		BackoffLimit:         f.CommandBackoffLimit,
+		Image:                f.CommandImage,
+		ImageDigest:          f.CommandImageDigest,
+		ImagePullSecrets:     f.CommandImagePullSecrets,
+		Namespace:            f.CommandNamespace,
+		PodTemplateConfigMap: f.CommandPodTemplateConfigMap,
+		PriorityClassName:    f.CommandPriorityClass,
+		Resources: apiv1.ResourceRequirements{
+			Limits: apiv1.ResourceList{
+				apiv1.ResourceCPU:    cpu,
+				apiv1.ResourceMemory: memory,
+			},
+			Requests: apiv1.ResourceList{
+				apiv1.ResourceCPU:    cpu,
+				apiv1.ResourceMemory: memory,
+			},
+		},
+		ServiceAccountName: f.CommandServiceAccount,
+	}
+
+	if f.CommandPodTemplateFile != "" {
+		data, err := os.ReadFile(f.CommandPodTemplateFile)
+		if err != nil {
+			return migrator.CommandJobConfig{}, microerror.Maskf(invalidFlagError, "--command-pod-template-file could not be read: %s", err)
+		}
+		c.PodTemplate, err = migrator.ParsePodTemplate(data)
+		if err != nil {
+			return migrator.CommandJobConfig{}, microerror.Maskf(invalidFlagError, "--command-pod-template-file: %s", err)
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+
+	"github.com/giantswarm/etcd-cluster-migrator/migrator"
+)
+
+func Test_runJob_InvalidConfigPushesMetrics(t *testing.T) {
+	var mutex sync.Mutex
+	var pushed string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		pushed = string(b)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	err := runJob(context.Background(), microloggertest.New(), migrator.MigratorConfig{}, s.URL)
+	if !migrator.IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error got %#v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !strings.Contains(pushed, "etcd_cluster_migrator_success") {
+		t.Fatalf("expected migration result to be pushed got %q", pushed)
+	}
+	if strings.Contains(pushed, "go_goroutines") || strings.Contains(pushed, "process_") {
+		t.Fatalf("expected only migration metrics to be pushed got %q", pushed)
+	}
+}
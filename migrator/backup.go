@@ -0,0 +1,185 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	etcdMemberDir = "/var/lib/etcd/member"
+	// nodeBackupDir is the directory on the nodes the etcd data directory
+	// and service file are moved to before a node gets configured.
+	nodeBackupDir = "/var/lib/etcd-cluster-migrator/backups"
+)
+
+// nodeBackup is a backup of the etcd data directory and the etcd3 service
+// file of a node.
+type nodeBackup struct {
+	Node      string `json:"node"`
+	Path      string `json:"path"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// backupPath returns a new timestamped backup directory on the nodes.
+func (m *Migrator) backupPath() string {
+	return path.Join(nodeBackupDir, m.clock.Now().UTC().Format("20060102T150405Z"))
+}
+
+// recordBackup adds the given backup to the migration state and persists it
+// before the commands creating it run, so that the backup is known even when
+// the migrator crashes while they run.
+func (m *Migrator) recordBackup(ctx context.Context, nodeName string, backupPath string) {
+	m.state.Backups = append(m.state.Backups, nodeBackup{
+		Node:      nodeName,
+		Path:      backupPath,
+		CreatedAt: m.clock.Now().UTC().Format(time.RFC3339),
+	})
+	m.persistState(ctx)
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("recorded backup of etcd data directory and service file to %s", backupPath), "node", nodeName)
+}
+
+// backupNodeCommands returns the commands copying the etcd3 service file and
+// moving the etcd data directory, if any, into the given backup directory.
+// Every command is executed in the host namespaces on its own, so the
+// condition runs in a shell.
+func backupNodeCommands(backupPath string) []string {
+	return []string{
+		fmt.Sprintf("mkdir -p %s", backupPath),
+		fmt.Sprintf("cp -p %s %s/", etcdServiceFile, backupPath),
+		fmt.Sprintf("sh -c 'if [ -d %s ]; then mv %s %s/; fi'", etcdMemberDir, etcdMemberDir, backupPath),
+	}
+}
+
+// checkNodeEtcd asks the etcd running on the given node for its member and
+// cluster ID before the node gets configured. It refuses to configure the
+// node when its etcd is a member of the live etcd cluster, or when it belongs
+// to another etcd cluster with more than one member. An etcd running on its
+// own, as set up for a new master, or a removed member of the live cluster
+// are expected.
+//
+// The etcd on the node may already be stopped by an interrupted run. An etcd
+// which does not answer is only accepted once the node shows that it has no
+// data directory, which the interrupted run moved to a backup.
+func (m *Migrator) checkNodeEtcd(ctx context.Context, nodeName string, clusterID uint64, members []*etcdserver.Member) error {
+	node, err := m.k8sClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	var answered bool
+	for _, endpoint := range m.nodeClientURLs(node) {
+		s, err := m.memberStatus(ctx, endpoint)
+		if err != nil {
+			m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd on node is not answering on %s", endpoint), "node", nodeName)
+			continue
+		}
+		answered = true
+		memberID := s.Header.MemberId
+
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd on node is member %x of cluster %x", memberID, s.Header.ClusterId), "node", nodeName, "memberID", fmt.Sprintf("%x", memberID))
+
+		if s.Header.ClusterId == clusterID {
+			for _, member := range members {
+				if member.ID == memberID {
+					return microerror.Maskf(preflightFailedError, "node %s runs etcd member %x with peer URLs %s of the etcd cluster, refusing to move its data directory", nodeName, memberID, member.PeerURLs)
+				}
+			}
+			continue
+		}
+
+		if s.Leader != memberID {
+			return microerror.Maskf(preflightFailedError, "node %s runs etcd member %x of cluster %x with leader %x, which is neither the etcd cluster %x nor a single member cluster, refusing to move its data directory", nodeName, memberID, s.Header.ClusterId, s.Leader, clusterID)
+		}
+	}
+
+	if !answered {
+		err = m.checkNodeDataMoved(ctx, nodeName)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	return nil
+}
+
+// checkNodeDataMoved refuses to configure the given node, whose etcd does not
+// answer, unless its etcd data directory does not exist. The etcd may be a
+// member of the etcd cluster which is just unavailable, and its data must not
+// be moved away then.
+func (m *Migrator) checkNodeDataMoved(ctx context.Context, nodeName string) error {
+	err := m.commandRunner.RunCommands(ctx, nodeName, []string{fmt.Sprintf("test ! -e %s", etcdMemberDir)})
+	if err != nil {
+		return microerror.Maskf(preflightFailedError, "etcd on node %s is not answering and its data directory %s may belong to a member of the etcd cluster, refusing to move it: %s", nodeName, etcdMemberDir, err)
+	}
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd on node is not answering and %s does not exist", etcdMemberDir), "node", nodeName)
+
+	return nil
+}
+
+// CleanupBackups removes the backups recorded in the migration state from
+// the nodes. It refuses to do so unless the etcd cluster has the desired
+// number of started and healthy members, as the backups are the only way
+// back to the previous etcd data.
+func (m *Migrator) CleanupBackups(ctx context.Context) error {
+	defer m.Close()
+
+	ctx, unlock, err := m.Lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	m.state, err = m.loadState(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	m.stateLoaded = true
+	if len(m.state.Backups) == 0 {
+		m.logger.LogCtx(ctx, "level", "info", "message", "no backups recorded, nothing to clean up")
+		return nil
+	}
+
+	members, err := m.memberList(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if len(members) != m.memberCount || !allStarted(members) {
+		return microerror.Maskf(preflightFailedError, "etcd cluster has %d members but expected %d started ones, keeping backups until the migration is complete", len(members), m.memberCount)
+	}
+	for _, member := range members {
+		if !m.isMemberHealthy(ctx, member) {
+			return microerror.Maskf(preflightFailedError, "member %x with peer URLs %s is not healthy, keeping backups until the migration is verified", member.ID, member.PeerURLs)
+		}
+	}
+
+	for i, b := range m.state.Backups {
+		// the path is read from a ConfigMap, so make sure nothing but a
+		// backup gets removed
+		if !strings.HasPrefix(b.Path, nodeBackupDir+"/") || strings.Contains(b.Path, "..") {
+			m.state.Backups = m.state.Backups[i:]
+			m.persistState(ctx)
+			return microerror.Maskf(executionFailedError, "backup path %s of node %s is outside of %s, refusing to remove it", b.Path, b.Node, nodeBackupDir)
+		}
+
+		err = m.commandRunner.RunCommands(ctx, b.Node, []string{fmt.Sprintf("rm -rf %s", b.Path)})
+		if err != nil {
+			m.state.Backups = m.state.Backups[i:]
+			m.persistState(ctx)
+			return microerror.Mask(err)
+		}
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("removed backup %s", b.Path), "node", b.Node)
+		m.recordNodeEvent(b.Node, apiv1.EventTypeNormal, eventReasonBackupRemoved, "removed etcd backup %s", b.Path)
+	}
+	m.state.Backups = nil
+	m.persistState(ctx)
+
+	return nil
+}
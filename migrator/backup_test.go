@@ -0,0 +1,198 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	apiv1 "k8s.io/api/core/v1"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_Migrator_checkNodeEtcd(t *testing.T) {
+	clusterID := uint64(100)
+	members := []*etcdserver.Member{
+		{ID: 1, Name: "etcd1", PeerURLs: []string{"https://etcd1.cluster.test:2380"}},
+		{ID: 2, Name: "etcd2", PeerURLs: []string{"https://etcd2.cluster.test:2380"}},
+	}
+
+	testCases := []struct {
+		name          string
+		addresses     []apiv1.NodeAddress
+		status        *etcdclientv3.StatusResponse
+		dataDirExists bool
+		errorMatcher  func(error) bool
+	}{
+		{
+			name: "case 0: node without internal IP",
+		},
+		{
+			name:      "case 1: etcd on node is not answering",
+			addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+		},
+		{
+			name:      "case 2: etcd on node runs on its own",
+			addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+			status:    testStatus(200, 9, 9),
+		},
+		{
+			name:         "case 3: etcd on node is a live member",
+			addresses:    []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+			status:       testStatus(clusterID, 2, 1),
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:      "case 4: etcd on node is a removed member",
+			addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+			status:    testStatus(clusterID, 7, 1),
+		},
+		{
+			name:         "case 5: etcd on node belongs to another cluster",
+			addresses:    []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+			status:       testStatus(300, 9, 8),
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:          "case 6: etcd on node is not answering but still a member",
+			addresses:     []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "10.0.0.3"}},
+			dataDirExists: true,
+			errorMatcher:  IsPreflightFailed,
+		},
+		{
+			name:          "case 7: node without internal IP has a data directory",
+			dataDirExists: true,
+			errorMatcher:  IsPreflightFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			node := &apiv1.Node{
+				ObjectMeta: apismetav1.ObjectMeta{
+					Name: "master-3",
+				},
+				Status: apiv1.NodeStatus{
+					Addresses: tc.addresses,
+				},
+			}
+
+			statuses := map[string]*etcdclientv3.StatusResponse{}
+			if tc.status != nil {
+				statuses["https://10.0.0.3:2379"] = tc.status
+			}
+
+			m := &Migrator{
+				etcdClient:     &testStatusClient{statuses: statuses},
+				k8sClient:      fake.NewSimpleClientset(node),
+				commandRunner:  &testDataDirRunner{exists: tc.dataDirExists},
+				logger:         microloggertest.New(),
+				nodeClientURLs: nodeClientURLs,
+			}
+
+			err := m.checkNodeEtcd(context.Background(), node.Name, clusterID, members)
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_Migrator_CleanupBackups(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	backup := nodeBackup{Node: testNodeName(2), Path: nodeBackupDir + "/20200501T120000Z"}
+	saveState := func() {
+		m := h.newMigrator()
+		m.state.Backups = []nodeBackup{backup}
+		err := m.saveState(context.Background())
+		if err != nil {
+			t.Fatalf("expected nil got %#v", err)
+		}
+	}
+	saveState()
+
+	// backups are kept as long as the migration is not complete
+	r := &testCommandRunner{h: h}
+	err := h.newMigratorWithRunner(r).CleanupBackups(context.Background())
+	if !IsPreflightFailed(err) {
+		t.Fatalf("expected preflight failed error got %#v", err)
+	}
+	if len(r.nodeNames) != 0 || len(h.state().Backups) != 1 {
+		t.Fatalf("expected backups to be kept got commands for %v and state %#v", r.nodeNames, h.state())
+	}
+
+	err = h.newMigrator().Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+	saveState()
+
+	r = &testCommandRunner{h: h}
+	err = h.newMigratorWithRunner(r).CleanupBackups(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if len(r.scripts) != 1 || r.nodeNames[0] != backup.Node || r.scripts[0] != "rm -rf "+backup.Path {
+		t.Fatalf("expected backup %s to be removed on %s got %v on %v", backup.Path, backup.Node, r.scripts, r.nodeNames)
+	}
+	if backups := h.state().Backups; len(backups) != 0 {
+		t.Fatalf("expected no backups in state got %#v", backups)
+	}
+}
+
+// testStatusClient answers status requests for the given endpoints only.
+// testDataDirRunner fails the commands testing that the etcd data directory
+// does not exist when it does.
+type testDataDirRunner struct {
+	exists bool
+}
+
+func (r *testDataDirRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	for _, c := range commands {
+		if r.exists && strings.Contains(c, "test ! -e "+etcdMemberDir) {
+			return fmt.Errorf("%s exists on node %s", etcdMemberDir, nodeName)
+		}
+	}
+
+	return nil
+}
+
+type testStatusClient struct {
+	EtcdClient
+	statuses map[string]*etcdclientv3.StatusResponse
+}
+
+func (c *testStatusClient) Status(ctx context.Context, endpoint string) (*etcdclientv3.StatusResponse, error) {
+	s, ok := c.statuses[endpoint]
+	if !ok {
+		return nil, fmt.Errorf("connection refused on %s", endpoint)
+	}
+
+	return s, nil
+}
+
+func testStatus(clusterID uint64, memberID uint64, leader uint64) *etcdclientv3.StatusResponse {
+	return &etcdclientv3.StatusResponse{
+		Header: &etcdserver.ResponseHeader{
+			ClusterId: clusterID,
+			MemberId:  memberID,
+		},
+		Leader: leader,
+	}
+}
@@ -0,0 +1,189 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+)
+
+const (
+	// nodeEtcdCertFile is the certificate etcd uses as server and peer
+	// certificate on the master nodes.
+	nodeEtcdCertFile = "/etc/kubernetes/ssl/etcd/server-crt.pem"
+	// nodeEtcdCaFile and nodeEtcdKeyFile are the etcd CA and the key of
+	// nodeEtcdCertFile on the master nodes.
+	nodeEtcdCaFile  = "/etc/kubernetes/ssl/etcd/server-ca.pem"
+	nodeEtcdKeyFile = "/etc/kubernetes/ssl/etcd/server-key.pem"
+
+	nodeFileBeginMarker = "### etcd-cluster-migrator begin "
+	nodeFileEndMarker   = "### etcd-cluster-migrator end"
+)
+
+// verifyNodeCertificates reads the etcd certificates of the given node and
+// verifies that they are valid, signed by the etcd CA and cover the host of
+// the peer URL of the member with the given index. It runs before the node
+// is configured, so that a member is never added with certificates it can
+// not join with.
+//
+// The certificates are read through the NodeCommandRunner, so the check is
+// skipped when it can not return the command output. It is skipped as well
+// for peer URLs without TLS.
+func (m *Migrator) verifyNodeCertificates(ctx context.Context, nodeName string, index int) error {
+	peerURL, err := url.Parse(m.etcdPeerURL(index))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if peerURL.Scheme != "https" {
+		m.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("peer URL %s does not use TLS, skipping certificate verification", peerURL), "step", phaseVerifyCerts, "node", nodeName)
+		return nil
+	}
+	host := peerURL.Hostname()
+
+	files, ok, err := m.readNodeFiles(ctx, nodeName, m.nodeCertFiles)
+	if err != nil {
+		return microerror.Mask(err)
+	} else if !ok {
+		m.logger.LogCtx(ctx, "level", "warning", "message", "node command runner does not return output, skipping certificate verification", "step", phaseVerifyCerts, "node", nodeName)
+		return nil
+	}
+
+	for _, file := range m.nodeCertFiles {
+		certPEM, ok := files[file]
+		if !ok || len(certPEM) == 0 {
+			return microerror.Maskf(preflightFailedError, "etcd certificate %s not found on node %s", file, nodeName)
+		}
+
+		err = verifyCertificate(certPEM, m.etcdCA, host, m.clock.Now())
+		if err != nil {
+			return microerror.Maskf(preflightFailedError, "etcd certificate %s on node %s: %s", file, nodeName, err)
+		}
+	}
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd certificates cover %s", host), "step", phaseVerifyCerts, "node", nodeName)
+
+	return nil
+}
+
+// verifyCertificate checks that the first certificate in the given PEM data
+// is valid at the given time, covers the given host and, when roots are
+// given, chains up to them. Further certificates are used as
+// intermediates.
+func verifyCertificate(certPEM []byte, roots *x509.CertPool, host string, now time.Time) error {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return microerror.Maskf(preflightFailedError, "found no PEM encoded certificate")
+	}
+	cert := certs[0]
+
+	if now.Before(cert.NotBefore) {
+		return microerror.Maskf(preflightFailedError, "certificate is not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return microerror.Maskf(preflightFailedError, "certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	err := cert.VerifyHostname(host)
+	if err != nil {
+		return microerror.Maskf(preflightFailedError, "certificate does not cover %s, its SANs are DNS names %v and IPs %v", host, cert.DNSNames, cert.IPAddresses)
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+
+		_, err = cert.Verify(x509.VerifyOptions{
+			CurrentTime:   now,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			Roots:         roots,
+		})
+		if err != nil {
+			return microerror.Maskf(preflightFailedError, "certificate of %s issued by %s is not signed by the etcd CA: %s", cert.Subject, cert.Issuer, err)
+		}
+	}
+
+	return nil
+}
+
+// readNodeFiles reads the given files from the node through the
+// NodeCommandRunner. It returns false when the runner can not return the
+// command output.
+func (m *Migrator) readNodeFiles(ctx context.Context, nodeName string, paths []string) (map[string][]byte, bool, error) {
+	runner, ok := m.commandRunner.(NodeCommandOutputRunner)
+	if !ok {
+		return nil, false, nil
+	}
+
+	output, err := runner.RunCommandsWithOutput(ctx, nodeName, readFileCommands(paths))
+	if err != nil {
+		return nil, true, microerror.Mask(err)
+	}
+
+	return parseNodeFiles(output), true, nil
+}
+
+// readFileCommands returns the commands printing the given files between
+// markers, as the output also contains the trace of the executed script.
+func readFileCommands(paths []string) []string {
+	var commands []string
+	for _, p := range paths {
+		commands = append(commands,
+			fmt.Sprintf("echo '%s%s'", nodeFileBeginMarker, p),
+			// a missing file must not fail the script
+			fmt.Sprintf("cat %s 2>/dev/null || true", p),
+			fmt.Sprintf("echo '%s'", nodeFileEndMarker),
+		)
+	}
+
+	return commands
+}
+
+// parseNodeFiles extracts the files printed by readFileCommands from the
+// given output. Trace lines of the shell are skipped.
+func parseNodeFiles(output []byte) map[string][]byte {
+	files := map[string][]byte{}
+
+	var current string
+	var content bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, nodeFileBeginMarker):
+			current = strings.TrimPrefix(line, nodeFileBeginMarker)
+			content.Reset()
+		case line == nodeFileEndMarker && current != "":
+			files[current] = append([]byte(nil), content.Bytes()...)
+			current = ""
+		case current != "" && !strings.HasPrefix(line, "+ "):
+			content.WriteString(line)
+			content.WriteString("\n")
+		}
+	}
+
+	return files
+}
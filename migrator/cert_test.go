@@ -0,0 +1,165 @@
+package migrator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_verifyCertificate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ca, caKey := testCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "etcd-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	otherCA, otherCAKey := testCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	testCases := []struct {
+		name         string
+		template     *x509.Certificate
+		issuer       *x509.Certificate
+		issuerKey    *ecdsa.PrivateKey
+		errorMatcher func(error) bool
+	}{
+		{
+			name: "case 0: certificate covers the peer host",
+			template: &x509.Certificate{
+				NotBefore: now.Add(-time.Hour),
+				NotAfter:  now.Add(time.Hour),
+				DNSNames:  []string{"etcd1.cluster.test", "etcd2.cluster.test"},
+			},
+			issuer:    ca,
+			issuerKey: caKey,
+		},
+		{
+			name: "case 1: certificate misses the peer host",
+			template: &x509.Certificate{
+				NotBefore: now.Add(-time.Hour),
+				NotAfter:  now.Add(time.Hour),
+				DNSNames:  []string{"etcd1.cluster.test"},
+			},
+			issuer:       ca,
+			issuerKey:    caKey,
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 2: certificate is expired",
+			template: &x509.Certificate{
+				NotBefore: now.Add(-2 * time.Hour),
+				NotAfter:  now.Add(-time.Hour),
+				DNSNames:  []string{"etcd2.cluster.test"},
+			},
+			issuer:       ca,
+			issuerKey:    caKey,
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 3: certificate is signed by another CA",
+			template: &x509.Certificate{
+				NotBefore: now.Add(-time.Hour),
+				NotAfter:  now.Add(time.Hour),
+				DNSNames:  []string{"etcd2.cluster.test"},
+			},
+			issuer:       otherCA,
+			issuerKey:    otherCAKey,
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 4: no certificate",
+			errorMatcher: IsPreflightFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var certPEM []byte
+			if tc.template != nil {
+				cert, _ := testCertificate(t, tc.issuer, tc.issuerKey, tc.template)
+				certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			}
+
+			err := verifyCertificate(certPEM, roots, "etcd2.cluster.test", now)
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_parseNodeFiles(t *testing.T) {
+	output := "+ echo '### etcd-cluster-migrator begin /a.pem'\n" +
+		"### etcd-cluster-migrator begin /a.pem\n" +
+		"+ cat /a.pem\n" +
+		"line 1\n" +
+		"line 2\n" +
+		"+ echo '### etcd-cluster-migrator end'\n" +
+		"### etcd-cluster-migrator end\n" +
+		"### etcd-cluster-migrator begin /b.pem\n" +
+		"+ cat /b.pem\n" +
+		"### etcd-cluster-migrator end\n"
+
+	files := parseNodeFiles([]byte(output))
+
+	expected := map[string][]byte{
+		"/a.pem": []byte("line 1\nline 2\n"),
+		"/b.pem": nil,
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("files == %q, want %q", files, expected)
+	}
+}
+
+// testCertificate creates a certificate from the given template. It is self
+// signed when no issuer is given.
+func testCertificate(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
@@ -18,7 +18,7 @@ func CertPoolFromFile(filename string) (*x509.CertPool, error) {
 	}
 	cp := x509.NewCertPool()
 	if !cp.AppendCertsFromPEM(b) {
-		return nil, microerror.Mask(err)
+		return nil, microerror.Maskf(invalidConfigError, "found no PEM encoded certificate in %s", filename)
 	}
 	return cp, nil
 }
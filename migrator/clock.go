@@ -0,0 +1,262 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/giantswarm/microerror"
+)
+
+const (
+	// defaultClockSkewWarning and defaultClockSkewLimit follow etcd, which
+	// warns about peers with a clock difference of more than a second.
+	defaultClockSkewWarning = time.Millisecond * 500
+	defaultClockSkewLimit   = time.Second
+
+	clockMarker = "### etcd-cluster-migrator clock "
+)
+
+// Sources of the offset of a node clock.
+const (
+	clockSourceChrony    = "chrony"
+	clockSourceTimesyncd = "timesyncd"
+	clockSourceMigrator  = "migrator"
+)
+
+// nodeClock is the clock of a master node compared to NTP time or the
+// migrator.
+type nodeClock struct {
+	Node string
+	// Offset is the offset of the node clock from NTP time as reported by
+	// the node, or else the least difference between the node clock and the
+	// migrator clock while the command ran on the node.
+	Offset time.Duration
+	// Source tells where the offset comes from, either chrony, timesyncd or
+	// migrator.
+	Source string
+	// Synchronized is the NTP synchronization state reported by
+	// timedatectl, either yes, no or unknown.
+	Synchronized string
+	// Window is the time it took to run the command on the node, which
+	// bounds the precision of an offset to the migrator clock.
+	Window time.Duration
+}
+
+// clockOutput is the clock of a node as printed by clockCommands.
+type clockOutput struct {
+	Time         time.Time
+	Synchronized string
+	// NTPOffset is the offset from NTP time reported by NTPSource, if the
+	// node reported one.
+	NTPOffset time.Duration
+	NTPSource string
+}
+
+// checkNodeClocks compares the clocks of the given nodes with NTP time or
+// the clock of the migrator and reports their NTP synchronization state. It
+// warns about offsets above the configured warning and unsynchronized
+// clocks, and fails when an offset exceeds the configured limit.
+//
+// The time of a node is read through the NodeCommandRunner, so the check is
+// skipped when it can not return the command output. The offset from NTP
+// time reported by chrony or systemd-timesyncd is used when available.
+// Otherwise the node time is compared with the period from starting to
+// finishing the command, which only shows an offset above the limit when
+// the command finished within the limit. A longer command leaves the check
+// inconclusive and fails it.
+func (m *Migrator) checkNodeClocks(ctx context.Context, nodeNames []string) error {
+	if m.clockSkewLimit < 0 {
+		return nil
+	}
+
+	runner, ok := m.commandRunner.(NodeCommandOutputRunner)
+	if !ok {
+		m.logger.LogCtx(ctx, "level", "warning", "message", "node command runner does not return output, skipping clock check", "step", phaseCheckClock)
+		return nil
+	}
+
+	var clocks []nodeClock
+	for _, nodeName := range nodeNames {
+		start := m.clock.Now()
+		output, err := runner.RunCommandsWithOutput(ctx, nodeName, clockCommands())
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		end := m.clock.Now()
+
+		o, err := parseClockOutput(output)
+		if err != nil {
+			return microerror.Maskf(preflightFailedError, "failed to read clock of node %s: %s", nodeName, err)
+		}
+
+		c := nodeClock{
+			Node:         nodeName,
+			Offset:       o.NTPOffset,
+			Source:       o.NTPSource,
+			Synchronized: o.Synchronized,
+			Window:       end.Sub(start),
+		}
+		if c.Source == "" {
+			c.Offset = clockOffset(o.Time, start, end)
+			c.Source = clockSourceMigrator
+		}
+		clocks = append(clocks, c)
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("clock check results\n%s", formatNodeClocks(clocks)), "step", phaseCheckClock)
+
+	var failures []string
+	for _, c := range clocks {
+		if c.Synchronized != "yes" {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("clock of node is not known to be synchronized with NTP (%s)", c.Synchronized), "step", phaseCheckClock, "node", c.Node)
+		}
+
+		skew := c.Offset
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > m.clockSkewLimit {
+			failures = append(failures, fmt.Sprintf("node %s is off by %s", c.Node, c.Offset))
+		} else if c.Source == clockSourceMigrator && c.Window > m.clockSkewLimit {
+			failures = append(failures, fmt.Sprintf("node %s reports no NTP offset and reading its clock took %s, so an offset up to that is not noticed", c.Node, c.Window))
+		} else if skew > m.clockSkewWarning {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("clock of node is off by %s, more than %s", c.Offset, m.clockSkewWarning), "step", phaseCheckClock, "node", c.Node)
+		}
+	}
+	if len(failures) > 0 {
+		return microerror.Maskf(preflightFailedError, "clock skew exceeds %s or can not be checked: %s", m.clockSkewLimit, strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// clockCommands returns the commands printing the time of the node and its
+// NTP synchronization state, and the offset from NTP time reported by chrony
+// or systemd-timesyncd, each after clockMarker.
+func clockCommands() []string {
+	return []string{
+		fmt.Sprintf(`sh -c 'echo "%s$(date +%%s.%%N) $(timedatectl show --property=NTPSynchronized --value 2>/dev/null || echo unknown)"'`, clockMarker),
+		fmt.Sprintf(`sh -c 'chronyc tracking 2>/dev/null | sed -n "s/^System time *: */%s%s /p"'`, clockMarker, clockSourceChrony),
+		fmt.Sprintf(`sh -c 'timedatectl timesync-status 2>/dev/null | sed -n "s/^ *Offset: */%s%s /p"'`, clockMarker, clockSourceTimesyncd),
+	}
+}
+
+// parseClockOutput returns the node clock printed by clockCommands.
+func parseClockOutput(output []byte) (clockOutput, error) {
+	var o clockOutput
+	var found bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, clockMarker) {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, clockMarker))
+		if len(fields) < 2 {
+			return clockOutput{}, microerror.Maskf(executionFailedError, "unexpected clock output %q", line)
+		}
+
+		switch fields[0] {
+		case clockSourceChrony, clockSourceTimesyncd:
+			offset, err := parseNTPOffset(fields[0], fields[1:])
+			if err != nil {
+				return clockOutput{}, microerror.Maskf(executionFailedError, "unexpected clock output %q: %s", line, err)
+			}
+			if o.NTPSource == "" {
+				o.NTPOffset = offset
+				o.NTPSource = fields[0]
+			}
+
+		default:
+			if len(fields) != 2 {
+				return clockOutput{}, microerror.Maskf(executionFailedError, "unexpected clock output %q", line)
+			}
+			sec, nsec, _ := strings.Cut(fields[0], ".")
+			s, err := strconv.ParseInt(sec, 10, 64)
+			if err != nil {
+				return clockOutput{}, microerror.Mask(err)
+			}
+			var ns int64
+			if nsec != "" {
+				ns, err = strconv.ParseInt(nsec, 10, 64)
+				if err != nil {
+					return clockOutput{}, microerror.Mask(err)
+				}
+			}
+			o.Time = time.Unix(s, ns)
+			o.Synchronized = fields[1]
+			found = true
+		}
+	}
+
+	if !found {
+		return clockOutput{}, microerror.Maskf(executionFailedError, "found no clock output")
+	}
+
+	return o, nil
+}
+
+// parseNTPOffset returns the offset of the node clock from NTP time, positive
+// when the node clock is ahead. chrony prints e.g. "0.000012 seconds fast of
+// NTP time", systemd-timesyncd e.g. "+1.234ms" or "-1min 2.5s".
+func parseNTPOffset(source string, fields []string) (time.Duration, error) {
+	if source == clockSourceChrony {
+		if len(fields) < 3 {
+			return 0, microerror.Maskf(executionFailedError, "expected seconds fast or slow of NTP time")
+		}
+		seconds, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, microerror.Mask(err)
+		}
+		offset := time.Duration(seconds * float64(time.Second))
+		switch fields[2] {
+		case "fast":
+			return offset, nil
+		case "slow":
+			return -offset, nil
+		default:
+			return 0, microerror.Maskf(executionFailedError, "expected fast or slow got %q", fields[2])
+		}
+	}
+
+	offset, err := time.ParseDuration(strings.ReplaceAll(strings.Join(fields, ""), "min", "m"))
+	if err != nil {
+		return 0, microerror.Mask(err)
+	}
+
+	return offset, nil
+}
+
+// clockOffset returns by how much the given node time lies outside of the
+// period from start to end, or zero if it lies within.
+func clockOffset(nodeTime time.Time, start time.Time, end time.Time) time.Duration {
+	if nodeTime.Before(start) {
+		return nodeTime.Sub(start)
+	}
+	if nodeTime.After(end) {
+		return nodeTime.Sub(end)
+	}
+	return 0
+}
+
+// formatNodeClocks returns a table of the given node clocks.
+func formatNodeClocks(clocks []nodeClock) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "NODE\tOFFSET\tSOURCE\tNTP SYNCHRONIZED")
+	for _, c := range clocks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Node, c.Offset, c.Source, c.Synchronized)
+	}
+	w.Flush()
+
+	return b.String()
+}
@@ -0,0 +1,224 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_Migrator_checkNodeClocks(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name         string
+		offsets      map[string]time.Duration
+		runtime      time.Duration
+		synchronized string
+		ntpOutput    string
+		output       string
+		errorMatcher func(error) bool
+	}{
+		{
+			name:         "case 0: clocks in sync",
+			synchronized: "yes",
+		},
+		{
+			name:         "case 1: node time within the command runtime",
+			offsets:      map[string]time.Duration{"master-2": time.Second},
+			synchronized: "yes",
+		},
+		{
+			name:         "case 2: clock above warning",
+			offsets:      map[string]time.Duration{"master-2": -time.Second * 3},
+			synchronized: "no",
+		},
+		{
+			name:         "case 3: clock above limit",
+			offsets:      map[string]time.Duration{"master-3": time.Second * 8},
+			synchronized: "yes",
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 4: clock behind limit",
+			offsets:      map[string]time.Duration{"master-1": -time.Minute},
+			synchronized: "unknown",
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 5: no clock output",
+			output:       "fake logs",
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 6: clock above limit within a longer command runtime",
+			offsets:      map[string]time.Duration{"master-2": time.Second * 5},
+			runtime:      time.Second * 12,
+			synchronized: "yes",
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 7: clock above limit reported by chrony",
+			runtime:      time.Second * 12,
+			synchronized: "yes",
+			ntpOutput:    clockMarker + "chrony 6.250000000 seconds slow of NTP time\n",
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 8: clock in sync reported by timesyncd within a longer command runtime",
+			offsets:      map[string]time.Duration{"master-2": time.Second * 5},
+			runtime:      time.Second * 12,
+			synchronized: "yes",
+			ntpOutput:    clockMarker + "timesyncd +1.234ms\n",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			clk := clocktesting.NewFakeClock(now)
+			r := &testClockRunner{
+				clock:        clk,
+				offsets:      tc.offsets,
+				runtime:      tc.runtime,
+				output:       tc.output,
+				ntpOutput:    tc.ntpOutput,
+				synchronized: tc.synchronized,
+			}
+			m := &Migrator{
+				clockSkewLimit:   time.Second * 5,
+				clockSkewWarning: time.Second,
+
+				clock:         clk,
+				commandRunner: r,
+				logger:        microloggertest.New(),
+			}
+
+			err := m.checkNodeClocks(context.Background(), []string{"master-1", "master-2", "master-3"})
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_parseClockOutput(t *testing.T) {
+	testCases := []struct {
+		name           string
+		output         string
+		expectedOffset time.Duration
+		expectedSource string
+		expectedTime   time.Time
+		expectedSynced string
+		errorMatcher   func(error) bool
+	}{
+		{
+			name: "case 0: node time only",
+			output: "+ nsenter -t 1 -m -u -n -i -- sh -c 'echo ...'\n" +
+				"### etcd-cluster-migrator clock 1704067200.250000000 yes\n",
+			expectedTime:   time.Date(2024, 1, 1, 0, 0, 0, 250000000, time.UTC),
+			expectedSynced: "yes",
+		},
+		{
+			name: "case 1: chrony offset",
+			output: "### etcd-cluster-migrator clock 1704067200.250000000 yes\n" +
+				"### etcd-cluster-migrator clock chrony 0.000250000 seconds slow of NTP time\n",
+			expectedOffset: -time.Microsecond * 250,
+			expectedSource: clockSourceChrony,
+			expectedTime:   time.Date(2024, 1, 1, 0, 0, 0, 250000000, time.UTC),
+			expectedSynced: "yes",
+		},
+		{
+			name: "case 2: timesyncd offset",
+			output: "### etcd-cluster-migrator clock 1704067200.250000000 no\n" +
+				"### etcd-cluster-migrator clock timesyncd -1min 2.5s\n",
+			expectedOffset: -(time.Minute + time.Millisecond*2500),
+			expectedSource: clockSourceTimesyncd,
+			expectedTime:   time.Date(2024, 1, 1, 0, 0, 0, 250000000, time.UTC),
+			expectedSynced: "no",
+		},
+		{
+			name:         "case 3: offset without node time",
+			output:       "### etcd-cluster-migrator clock timesyncd +1.234ms\n",
+			errorMatcher: IsExecutionFailed,
+		},
+		{
+			name: "case 4: unexpected chrony offset",
+			output: "### etcd-cluster-migrator clock 1704067200.250000000 yes\n" +
+				"### etcd-cluster-migrator clock chrony 0.25 seconds\n",
+			errorMatcher: IsExecutionFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			o, err := parseClockOutput([]byte(tc.output))
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+			if tc.errorMatcher != nil {
+				return
+			}
+
+			if !o.Time.Equal(tc.expectedTime) {
+				t.Fatalf("%s: node time == %s, want %s", tc.name, o.Time, tc.expectedTime)
+			}
+			if o.Synchronized != tc.expectedSynced {
+				t.Fatalf("%s: synchronized == %q, want %q", tc.name, o.Synchronized, tc.expectedSynced)
+			}
+			if o.NTPOffset != tc.expectedOffset || o.NTPSource != tc.expectedSource {
+				t.Fatalf("%s: NTP offset == %s from %q, want %s from %q", tc.name, o.NTPOffset, o.NTPSource, tc.expectedOffset, tc.expectedSource)
+			}
+		})
+	}
+}
+
+// testClockRunner prints the output of clockCommands with the time of the
+// given clock shifted by the offset of the node, followed by the given NTP
+// output. The node time is read in the middle of the given runtime, which
+// defaults to two seconds.
+type testClockRunner struct {
+	clock        *clocktesting.FakeClock
+	offsets      map[string]time.Duration
+	runtime      time.Duration
+	output       string
+	ntpOutput    string
+	synchronized string
+}
+
+func (r *testClockRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	return nil
+}
+
+func (r *testClockRunner) RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error) {
+	runtime := r.runtime
+	if runtime == 0 {
+		runtime = time.Second * 2
+	}
+	r.clock.Step(runtime / 2)
+	nodeTime := r.clock.Now().Add(r.offsets[nodeName])
+	r.clock.Step(runtime / 2)
+
+	if r.output != "" {
+		return []byte(r.output), nil
+	}
+
+	return []byte(fmt.Sprintf("%s%d.%09d %s\n%s", clockMarker, nodeTime.Unix(), nodeTime.Nanosecond(), r.synchronized, r.ntpOutput)), nil
+}
@@ -2,63 +2,287 @@ package migrator
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
 	batchapiv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/yaml"
 
 	"github.com/giantswarm/etcd-cluster-migrator/pkg/project"
 )
 
 const (
-	runCommandConfigMap     = "etcd-cluster-migrator-cm"
-	runCommandDockerImage   = "giantswarm/alpine:3.11.6"
-	runCommandNamespace     = apismetav1.NamespaceSystem
-	runCommandPriorityClass = "system-cluster-critical"
-	runCommandSAName        = "etcd-cluster-migrator-cmd"
-	runCommandVolume        = "command-volume"
+	runCommandActiveDeadline = time.Second * 240
+	runCommandBackoffLimit   = 10
+	runCommandConfigMap      = "etcd-cluster-migrator-cm"
+	runCommandContainer      = "run-command"
+	runCommandDockerImage    = "giantswarm/alpine:3.11.6"
+	runCommandNamespace      = apismetav1.NamespaceSystem
+	runCommandPodTemplateKey = "podTemplate"
+	runCommandPollInterval   = time.Second * 5
+	runCommandPriorityClass  = "system-cluster-critical"
+	runCommandSAName         = "etcd-cluster-migrator-cmd"
+	runCommandSecret         = "etcd-cluster-migrator-files"
+	runCommandSecretDir      = "/files/"
+	runCommandSecretVolume   = "files-volume"
+	runCommandVolume         = "command-volume"
 
 	nsenterCommand = "nsenter -t 1 -m -u -n -i -- "
-
-	waitJobCompleted = time.Second * 5
 )
 
-// runCommandsOnNode will execute command list on the specified node in the host namespace.
-func (m *Migrator) runCommandsOnNode(ctx context.Context, nodeName string, commands []string) error {
+// NodeCommandRunner executes shell commands on a master node in the host
+// namespaces.
+type NodeCommandRunner interface {
+	// RunCommands executes the given commands in order on the node with the
+	// given name and returns once all of them succeeded.
+	RunCommands(ctx context.Context, nodeName string, commands []string) error
+}
+
+// CommandJobConfig configures the privileged Jobs executing commands on the
+// master nodes when no NodeCommandRunner is injected. Empty fields use the
+// defaults.
+type CommandJobConfig struct {
+	// ActiveDeadline is the time a Job may run before it is recreated.
+	// Defaults to 240s.
+	ActiveDeadline time.Duration
+	// BackoffLimit is the number of retries of the Job's pod. Defaults to 10.
+	BackoffLimit int32
+	// Image is the full reference of the image executing the commands.
+	// Defaults to giantswarm/alpine:3.11.6 in the DockerRegistry.
+	Image string
+	// ImageDigest pins the Image to a digest, e.g. sha256:abc...
+	ImageDigest      string
+	ImagePullSecrets []string
+	// Namespace is the namespace the Jobs and their command ConfigMap are
+	// created in. The migration lock and state are kept in it as well.
+	// Defaults to kube-system.
+	Namespace string
+	// PollInterval is the interval in which a Job is checked for
+	// completion. Defaults to 5s.
+	PollInterval time.Duration
+	// PodTemplate is merged into the generated pod template using a
+	// strategic merge patch, so e.g. the run-command container can be
+	// changed by its name.
+	PodTemplate *apiv1.PodTemplateSpec
+	// PodTemplateConfigMap is the name of a ConfigMap in Namespace with a
+	// pod template in YAML in its podTemplate key. It is read for every Job
+	// and merged after PodTemplate.
+	PodTemplateConfigMap string
+	// PriorityClassName defaults to system-cluster-critical.
+	PriorityClassName string
+	// Resources default to 50m CPU and 50Mi memory as requests and limits.
+	Resources          apiv1.ResourceRequirements
+	ServiceAccountName string
+}
+
+// withDefaults returns the configuration with the defaults for all empty
+// fields set.
+func (c CommandJobConfig) withDefaults(dockerRegistry string) CommandJobConfig {
+	if c.ActiveDeadline == 0 {
+		c.ActiveDeadline = runCommandActiveDeadline
+	}
+	if c.BackoffLimit == 0 {
+		c.BackoffLimit = runCommandBackoffLimit
+	}
+	if c.Image == "" {
+		c.Image = jobDockerImage(dockerRegistry)
+	}
+	if c.Namespace == "" {
+		c.Namespace = runCommandNamespace
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = runCommandPollInterval
+	}
+	if c.PriorityClassName == "" {
+		c.PriorityClassName = runCommandPriorityClass
+	}
+	if len(c.Resources.Limits) == 0 && len(c.Resources.Requests) == 0 {
+		cpu := resource.MustParse("50m")
+		memory := resource.MustParse("50Mi")
+		c.Resources = apiv1.ResourceRequirements{
+			Limits: apiv1.ResourceList{
+				apiv1.ResourceCPU:    cpu,
+				apiv1.ResourceMemory: memory,
+			},
+			Requests: apiv1.ResourceList{
+				apiv1.ResourceCPU:    cpu,
+				apiv1.ResourceMemory: memory,
+			},
+		}
+	}
+	if c.ServiceAccountName == "" {
+		c.ServiceAccountName = runCommandSAName
+	}
+
+	return c
+}
+
+// validate returns an invalidConfigError for settings the Job can not be
+// built with.
+func (c CommandJobConfig) validate() error {
+	if c.ActiveDeadline < 0 {
+		return microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.ActiveDeadline must not be negative", c))
+	}
+	if c.BackoffLimit < 0 {
+		return microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.BackoffLimit must not be negative", c))
+	}
+	if c.PollInterval < 0 {
+		return microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.PollInterval must not be negative", c))
+	}
+	if c.ImageDigest != "" && !strings.HasPrefix(c.ImageDigest, "sha256:") {
+		return microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.ImageDigest must be a sha256 digest, e.g. sha256:abc..., got %q", c, c.ImageDigest))
+	}
+	if c.ImageDigest != "" && strings.Contains(c.Image, "@") {
+		return microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.Image must not contain a digest when %T.ImageDigest is set", c, c))
+	}
+
+	return nil
+}
+
+// NodeCommandOutputRunner is implemented by NodeCommandRunners which can
+// return the output of the executed commands, e.g. to read files from the
+// nodes. Checks which need the output are skipped for other runners.
+type NodeCommandOutputRunner interface {
+	// RunCommandsWithOutput executes the given commands like RunCommands
+	// and returns their combined output.
+	RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error)
+}
+
+// NodeCommandFileRunner is implemented by NodeCommandRunners which can write
+// files to the nodes without their content being part of the commands, e.g.
+// private keys which must not show up in scripts or logs. Issuing
+// certificates requires such a runner.
+type NodeCommandFileRunner interface {
+	// RunCommandsWithFiles writes the given files, keyed by their path on
+	// the node, readable by root only and then executes the given commands
+	// like RunCommands.
+	RunCommandsWithFiles(ctx context.Context, nodeName string, files map[string][]byte, commands []string) error
+}
+
+// jobCommandRunner is the default NodeCommandRunner. It executes commands
+// through a privileged Job scheduled on the node.
+type jobCommandRunner struct {
+	clock     clock.Clock
+	config    CommandJobConfig
+	k8sClient kubernetes.Interface
+	logger    micrologger.Logger
+}
+
+// RunCommands will execute command list on the specified node in the host namespace.
+func (r *jobCommandRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	_, err := r.runCommands(ctx, nodeName, nil, commands, false)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// RunCommandsWithOutput executes the commands like RunCommands and returns
+// the log of the job's pod.
+func (r *jobCommandRunner) RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error) {
+	output, err := r.runCommands(ctx, nodeName, nil, commands, true)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return output, nil
+}
+
+// RunCommandsWithFiles passes the files through a Secret mounted by the job,
+// which copies them to the node before executing the commands. The Secret is
+// deleted once the job finished.
+func (r *jobCommandRunner) RunCommandsWithFiles(ctx context.Context, nodeName string, files map[string][]byte, commands []string) error {
+	_, err := r.runCommands(ctx, nodeName, files, commands, false)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+func (r *jobCommandRunner) runCommands(ctx context.Context, nodeName string, files map[string][]byte, commands []string, withOutput bool) ([]byte, error) {
+	var output []byte
+
+	// secret for the job holding the files, which is only kept while the job
+	// runs
+	paths, secret := buildFilesSecret(files)
+	{
+		// ensure there is no secret left by an interrupted run
+		err := r.k8sClient.CoreV1().Secrets(r.config.Namespace).Delete(ctx, runCommandSecret, apismetav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			// It is fine as its is just safe check before creating.
+		} else if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		if secret != nil {
+			_, err = r.k8sClient.CoreV1().Secrets(r.config.Namespace).Create(ctx, secret, apismetav1.CreateOptions{})
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			defer func() {
+				// the context may be cancelled, the files must be removed
+				// nevertheless
+				err := r.k8sClient.CoreV1().Secrets(r.config.Namespace).Delete(context.Background(), secret.Name, apismetav1.DeleteOptions{})
+				if err != nil && !k8serrors.IsNotFound(err) {
+					r.logger.LogCtx(ctx, "level", "error", "message", fmt.Sprintf("failed to delete secret %s/%s", r.config.Namespace, secret.Name), "stack", microerror.JSON(err))
+				}
+			}()
+		}
+	}
+
 	// configmap for the job where commands will be stored in a single bash file
 	{
-		cm := buildConfigMapFile(commands)
+		cm := buildConfigMapFile(paths, commands)
 		// ensure there is no configmap present
-		err := m.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Delete(ctx, cm.Name, apismetav1.DeleteOptions{})
+		err := r.k8sClient.CoreV1().ConfigMaps(r.config.Namespace).Delete(ctx, cm.Name, apismetav1.DeleteOptions{})
 		if k8serrors.IsNotFound(err) {
 			// It is fine as its is just safe check before creating.
 		} else if err != nil {
-			return microerror.Mask(err)
+			return nil, microerror.Mask(err)
 		}
 
-		_, err = m.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Create(ctx, cm, apismetav1.CreateOptions{})
+		_, err = r.k8sClient.CoreV1().ConfigMaps(r.config.Namespace).Create(ctx, cm, apismetav1.CreateOptions{})
 		if err != nil {
-			return microerror.Mask(err)
+			return nil, microerror.Mask(err)
 		}
 	}
 	// run command on the node
 	{
-		job := buildCommandJob(nodeName, m.dockerRegistry)
-		err := m.k8sClient.BatchV1().Jobs(runCommandNamespace).Delete(ctx, job.Name, apismetav1.DeleteOptions{})
+		node, err := r.k8sClient.CoreV1().Nodes().Get(ctx, nodeName, apismetav1.GetOptions{})
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		job := buildCommandJob(node, r.config, secret != nil)
+		err = r.mergePodTemplates(ctx, &job.Spec.Template)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		err = r.k8sClient.BatchV1().Jobs(r.config.Namespace).Delete(ctx, job.Name, apismetav1.DeleteOptions{})
 		if k8serrors.IsNotFound(err) {
 			// It is fine as its is just safe check before creating.
 		} else if err != nil {
-			return microerror.Mask(err)
+			return nil, microerror.Mask(err)
 		}
 
-		job, err = m.k8sClient.BatchV1().Jobs(runCommandNamespace).Create(ctx, job, apismetav1.CreateOptions{})
+		job, err = r.k8sClient.BatchV1().Jobs(r.config.Namespace).Create(ctx, job, apismetav1.CreateOptions{})
 		if err != nil {
-			return microerror.Mask(err)
+			return nil, microerror.Mask(err)
 		}
 
 		// deletePropagationPolicy ensures that all child resources are deleted as well before deleting the resource
@@ -69,42 +293,145 @@ func (m *Migrator) runCommandsOnNode(ctx context.Context, nodeName string, comma
 		}
 
 		for {
-			fmt.Printf("Waiting for job %s to be completed\n", job.Name)
-			time.Sleep(waitJobCompleted)
+			r.logger.LogCtx(ctx, "level", "debug", "message", "waiting for job to be completed", "node", nodeName, "jobName", job.Name)
+			err = sleep(ctx, r.clock, r.config.PollInterval)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
 
-			job, err := m.k8sClient.BatchV1().Jobs(runCommandNamespace).Get(ctx, job.Name, apismetav1.GetOptions{})
+			job, err := r.k8sClient.BatchV1().Jobs(r.config.Namespace).Get(ctx, job.Name, apismetav1.GetOptions{})
 			if err != nil {
-				return microerror.Mask(err)
+				return nil, microerror.Mask(err)
 			}
 
 			if isDeadlineExceeded(job) {
-				fmt.Printf("Job %s has status failed due deadline exceeded, recreating job.\n", job.Name)
+				r.logger.LogCtx(ctx, "level", "warning", "message", "job failed due to exceeded deadline, recreating job", "node", nodeName, "jobName", job.Name)
+				jobRetriesCounter.WithLabelValues(nodeName).Inc()
 
-				err := m.k8sClient.BatchV1().Jobs(runCommandNamespace).Delete(ctx, job.Name, delOptions)
+				err := r.k8sClient.BatchV1().Jobs(r.config.Namespace).Delete(ctx, job.Name, delOptions)
 				if err != nil {
-					return microerror.Mask(err)
+					return nil, microerror.Mask(err)
 				}
-				_, err = m.k8sClient.BatchV1().Jobs(runCommandNamespace).Create(ctx, job, apismetav1.CreateOptions{})
+				_, err = r.k8sClient.BatchV1().Jobs(r.config.Namespace).Create(ctx, job, apismetav1.CreateOptions{})
 				if err != nil {
-					return microerror.Mask(err)
+					return nil, microerror.Mask(err)
 				}
 			}
 
 			if isJobCompleted(job) {
-				fmt.Printf("Job %s was completed.\n", job.Name)
+				r.logger.LogCtx(ctx, "level", "info", "message", "job completed", "node", nodeName, "jobName", job.Name)
 
-				err := m.k8sClient.BatchV1().Jobs(runCommandNamespace).Delete(ctx, job.Name, delOptions)
+				// the pod is deleted along with the job
+				if withOutput {
+					output, err = r.jobOutput(ctx, job.Name)
+					if err != nil {
+						return nil, microerror.Mask(err)
+					}
+				}
+
+				err := r.k8sClient.BatchV1().Jobs(r.config.Namespace).Delete(ctx, job.Name, delOptions)
 				if err != nil {
-					return microerror.Mask(err)
+					return nil, microerror.Mask(err)
 				}
 				break
 			}
 		}
 	}
 
+	return output, nil
+}
+
+// jobOutput returns the log of the succeeded pod of the job with the given
+// name.
+func (r *jobCommandRunner) jobOutput(ctx context.Context, jobName string) ([]byte, error) {
+	pods, err := r.k8sClient.CoreV1().Pods(r.config.Namespace).List(ctx, apismetav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%s", jobName)})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != apiv1.PodSucceeded {
+			continue
+		}
+
+		output, err := r.k8sClient.CoreV1().Pods(r.config.Namespace).GetLogs(pod.Name, &apiv1.PodLogOptions{Container: runCommandContainer}).DoRaw(ctx)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		return output, nil
+	}
+
+	return nil, microerror.Maskf(executionFailedError, "found no succeeded pod of job %s", jobName)
+}
+
+// mergePodTemplates merges the configured pod templates into the given one.
+func (r *jobCommandRunner) mergePodTemplates(ctx context.Context, template *apiv1.PodTemplateSpec) error {
+	if r.config.PodTemplate != nil {
+		merged, err := mergePodTemplate(*template, *r.config.PodTemplate)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		*template = merged
+	}
+
+	if r.config.PodTemplateConfigMap != "" {
+		cm, err := r.k8sClient.CoreV1().ConfigMaps(r.config.Namespace).Get(ctx, r.config.PodTemplateConfigMap, apismetav1.GetOptions{})
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		override, err := ParsePodTemplate([]byte(cm.Data[runCommandPodTemplateKey]))
+		if err != nil {
+			return microerror.Maskf(invalidConfigError, "ConfigMap %s/%s: %s", r.config.Namespace, r.config.PodTemplateConfigMap, err)
+		}
+		merged, err := mergePodTemplate(*template, *override)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		*template = merged
+	}
+
 	return nil
 }
 
+// ParsePodTemplate parses a pod template override in YAML or JSON. Unknown
+// fields are rejected so that typos do not go unnoticed.
+func ParsePodTemplate(data []byte) (*apiv1.PodTemplateSpec, error) {
+	var template apiv1.PodTemplateSpec
+	err := yaml.UnmarshalStrict(data, &template)
+	if err != nil {
+		return nil, microerror.Maskf(invalidConfigError, "invalid pod template: %s", err)
+	}
+
+	return &template, nil
+}
+
+// mergePodTemplate applies the override to the given pod template using a
+// strategic merge patch, which merges lists like containers and tolerations
+// by their keys instead of replacing them.
+func mergePodTemplate(template apiv1.PodTemplateSpec, override apiv1.PodTemplateSpec) (apiv1.PodTemplateSpec, error) {
+	original, err := json.Marshal(template)
+	if err != nil {
+		return apiv1.PodTemplateSpec{}, microerror.Mask(err)
+	}
+	patch, err := json.Marshal(override)
+	if err != nil {
+		return apiv1.PodTemplateSpec{}, microerror.Mask(err)
+	}
+
+	b, err := strategicpatch.StrategicMergePatch(original, patch, apiv1.PodTemplateSpec{})
+	if err != nil {
+		return apiv1.PodTemplateSpec{}, microerror.Maskf(invalidConfigError, "failed to merge pod template: %s", err)
+	}
+
+	var merged apiv1.PodTemplateSpec
+	err = json.Unmarshal(b, &merged)
+	if err != nil {
+		return apiv1.PodTemplateSpec{}, microerror.Mask(err)
+	}
+
+	return merged, nil
+}
+
 func isJobCompleted(j *batchapiv1.Job) bool {
 	for _, c := range j.Status.Conditions {
 		if c.Type == "Complete" && c.Status == apiv1.ConditionTrue {
@@ -125,16 +452,68 @@ func isDeadlineExceeded(j *batchapiv1.Job) bool {
 
 // buildCommandJob return job that will execute commands on a node in host namespace.
 // The executed file is taken from configmap which is mounted to the pod.
-func buildCommandJob(nodeName string, dockerRegistry string) *batchapiv1.Job {
-	activeDeadlineSeconds := int64(240)
-	backOffLimit := int32(10)
+func buildCommandJob(node *apiv1.Node, c CommandJobConfig, withFiles bool) *batchapiv1.Job {
+	activeDeadlineSeconds := int64(c.ActiveDeadline.Seconds())
+	backOffLimit := c.BackoffLimit
 	completions := int32(1)
 	privileged := true
-	priority := int32(2000000000)
 	parallelism := int32(1)
 	jobName := fmt.Sprintf("%s-command", project.Name())
-	cpu := resource.MustParse("50m")
-	memory := resource.MustParse("50Mi")
+
+	// the priority admission resolves the priority of other classes, the
+	// value is only known for the default class
+	var priority *int32
+	if c.PriorityClassName == runCommandPriorityClass {
+		p := int32(2000000000)
+		priority = &p
+	}
+
+	image := c.Image
+	if c.ImageDigest != "" {
+		image = fmt.Sprintf("%s@%s", image, c.ImageDigest)
+	}
+
+	var pullSecrets []apiv1.LocalObjectReference
+	for _, name := range c.ImagePullSecrets {
+		pullSecrets = append(pullSecrets, apiv1.LocalObjectReference{Name: name})
+	}
+
+	volumeMounts := []apiv1.VolumeMount{
+		{
+			Name:      runCommandVolume,
+			MountPath: "/data/",
+			ReadOnly:  true,
+		},
+	}
+	volumes := []apiv1.Volume{
+		{
+			Name: runCommandVolume,
+			VolumeSource: apiv1.VolumeSource{
+				ConfigMap: &apiv1.ConfigMapVolumeSource{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: runCommandConfigMap,
+					},
+				},
+			},
+		},
+	}
+	if withFiles {
+		mode := int32(0400)
+		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
+			Name:      runCommandSecretVolume,
+			MountPath: runCommandSecretDir,
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, apiv1.Volume{
+			Name: runCommandSecretVolume,
+			VolumeSource: apiv1.VolumeSource{
+				Secret: &apiv1.SecretVolumeSource{
+					SecretName:  runCommandSecret,
+					DefaultMode: &mode,
+				},
+			},
+		})
+	}
 
 	j := batchapiv1.Job{
 		TypeMeta: apismetav1.TypeMeta{
@@ -143,7 +522,7 @@ func buildCommandJob(nodeName string, dockerRegistry string) *batchapiv1.Job {
 		},
 		ObjectMeta: apismetav1.ObjectMeta{
 			Name:      jobName,
-			Namespace: runCommandNamespace,
+			Namespace: c.Namespace,
 			Labels: map[string]string{
 				"app":        jobName,
 				"created-by": project.Name(),
@@ -157,18 +536,9 @@ func buildCommandJob(nodeName string, dockerRegistry string) *batchapiv1.Job {
 				Spec: apiv1.PodSpec{
 					Containers: []apiv1.Container{
 						{
-							Name:  "run-command",
-							Image: jobDockerImage(dockerRegistry),
-							Resources: apiv1.ResourceRequirements{
-								Limits: apiv1.ResourceList{
-									apiv1.ResourceCPU:    cpu,
-									apiv1.ResourceMemory: memory,
-								},
-								Requests: apiv1.ResourceList{
-									apiv1.ResourceCPU:    cpu,
-									apiv1.ResourceMemory: memory,
-								},
-							},
+							Name:      runCommandContainer,
+							Image:     image,
+							Resources: c.Resources,
 							SecurityContext: &apiv1.SecurityContext{
 								Privileged:               &privileged,
 								AllowPrivilegeEscalation: &privileged,
@@ -177,46 +547,20 @@ func buildCommandJob(nodeName string, dockerRegistry string) *batchapiv1.Job {
 								"/bin/sh",
 								"/data/command.sh",
 							},
-							VolumeMounts: []apiv1.VolumeMount{
-								{
-									Name:      runCommandVolume,
-									MountPath: "/data/",
-									ReadOnly:  true,
-								},
-							},
+							VolumeMounts: volumeMounts,
 						},
 					},
-					HostPID: true,
+					HostPID:          true,
+					ImagePullSecrets: pullSecrets,
 					NodeSelector: map[string]string{
-						"kubernetes.io/hostname": nodeName,
+						"kubernetes.io/hostname": node.Name,
 					},
 					RestartPolicy:      apiv1.RestartPolicyNever,
-					Priority:           &priority,
-					PriorityClassName:  runCommandPriorityClass,
-					ServiceAccountName: runCommandSAName,
-					Tolerations: []apiv1.Toleration{
-						{
-							Key:      "node.kubernetes.io/unschedulable",
-							Operator: "Exists",
-							Effect:   "NoSchedule",
-						},
-						{
-							Key:    "node-role.kubernetes.io/master",
-							Effect: "NoSchedule",
-						},
-					},
-					Volumes: []apiv1.Volume{
-						{
-							Name: runCommandVolume,
-							VolumeSource: apiv1.VolumeSource{
-								ConfigMap: &apiv1.ConfigMapVolumeSource{
-									LocalObjectReference: apiv1.LocalObjectReference{
-										Name: runCommandConfigMap,
-									},
-								},
-							},
-						},
-					},
+					Priority:           priority,
+					PriorityClassName:  c.PriorityClassName,
+					ServiceAccountName: c.ServiceAccountName,
+					Tolerations:        nodeTolerations(node),
+					Volumes:            volumes,
 				},
 			},
 			ActiveDeadlineSeconds: &activeDeadlineSeconds,
@@ -225,12 +569,76 @@ func buildCommandJob(nodeName string, dockerRegistry string) *batchapiv1.Job {
 	return &j
 }
 
+// nodeTolerations returns tolerations for the taints present on the given
+// node, so that the job is scheduled on it whether it is tainted as master,
+// control-plane or e.g. not ready.
+func nodeTolerations(node *apiv1.Node) []apiv1.Toleration {
+	var tolerations []apiv1.Toleration
+	for _, t := range node.Spec.Taints {
+		tolerations = append(tolerations, apiv1.Toleration{
+			Key:      t.Key,
+			Operator: apiv1.TolerationOpExists,
+			Effect:   t.Effect,
+		})
+	}
+
+	return tolerations
+}
+
+// buildFilesSecret returns the Secret holding the given files under the keys
+// file-0, file-1, ... and the paths of the files on the node in the order of
+// the keys. It returns no Secret when there are no files.
+func buildFilesSecret(files map[string][]byte) ([]string, *apiv1.Secret) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	data := map[string][]byte{}
+	for i, p := range paths {
+		data[fmt.Sprintf("file-%d", i)] = files[p]
+	}
+
+	secret := &apiv1.Secret{
+		TypeMeta: apismetav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: apiv1.GroupName,
+		},
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name: runCommandSecret,
+			Labels: map[string]string{
+				"app":        runCommandSecret,
+				"created-by": project.Name(),
+			},
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	return paths, secret
+}
+
 // buildConfigMapFile return configmap which has content of the bash file which has the commands.
 // This configmap should be used as volume for the pod where it will be executed.
-func buildConfigMapFile(cmds []string) *apiv1.ConfigMap {
+// The files of the Secret built for the given paths are copied to the node
+// first. They are copied from the container through the root of the host's
+// init process, and tracing is turned off meanwhile.
+func buildConfigMapFile(paths []string, cmds []string) *apiv1.ConfigMap {
 	configMapContent := `#/bin/bash
 set -xe
 `
+	if len(paths) > 0 {
+		configMapContent += "set +x\n"
+		for i, p := range paths {
+			configMapContent += fmt.Sprintf("install -D -m 0600 %sfile-%d /proc/1/root%s\n", runCommandSecretDir, i, p)
+		}
+		configMapContent += "set -x\n"
+	}
 	for _, c := range cmds {
 		configMapContent += nsenterCommand + c + "\n"
 	}
@@ -0,0 +1,205 @@
+package migrator
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_buildCommandJob_Tolerations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		taints      []v1.Taint
+		expectedKey []string
+	}{
+		{
+			name: "case 0: legacy master taint",
+			taints: []v1.Taint{
+				{Key: "node-role.kubernetes.io/master", Effect: v1.TaintEffectNoSchedule},
+			},
+			expectedKey: []string{"node-role.kubernetes.io/master"},
+		},
+		{
+			name: "case 1: control-plane and not ready taints",
+			taints: []v1.Taint{
+				{Key: "node-role.kubernetes.io/control-plane", Effect: v1.TaintEffectNoSchedule},
+				{Key: "node.kubernetes.io/not-ready", Effect: v1.TaintEffectNoExecute},
+			},
+			expectedKey: []string{"node-role.kubernetes.io/control-plane", "node.kubernetes.io/not-ready"},
+		},
+		{
+			name: "case 2: untainted node",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			node := &v1.Node{
+				ObjectMeta: apismetav1.ObjectMeta{
+					Name: "node-1",
+				},
+				Spec: v1.NodeSpec{
+					Taints: tc.taints,
+				},
+			}
+
+			job := buildCommandJob(node, CommandJobConfig{}.withDefaults("quay.io"), false)
+
+			tolerations := job.Spec.Template.Spec.Tolerations
+			if len(tolerations) != len(tc.expectedKey) {
+				t.Fatalf("%s: expected %d tolerations got %#v", tc.name, len(tc.expectedKey), tolerations)
+			}
+			for i, toleration := range tolerations {
+				if toleration.Key != tc.expectedKey[i] || toleration.Effect != tc.taints[i].Effect || toleration.Operator != v1.TolerationOpExists {
+					t.Fatalf("%s: expected toleration for taint %#v got %#v", tc.name, tc.taints[i], toleration)
+				}
+			}
+			if job.Spec.Template.Spec.NodeSelector["kubernetes.io/hostname"] != node.Name {
+				t.Fatalf("%s: expected job to be scheduled on %s got %v", tc.name, node.Name, job.Spec.Template.Spec.NodeSelector)
+			}
+		})
+	}
+}
+
+func Test_buildCommandJob_Config(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name: "node-1",
+		},
+	}
+
+	c := CommandJobConfig{
+		ActiveDeadline:     time.Minute,
+		Image:              "registry.local/alpine:3.19",
+		ImageDigest:        "sha256:abc",
+		ImagePullSecrets:   []string{"pull-secret"},
+		Namespace:          "migration",
+		PriorityClassName:  "custom",
+		ServiceAccountName: "custom-sa",
+	}
+	job := buildCommandJob(node, c.withDefaults("quay.io"), false)
+
+	spec := job.Spec.Template.Spec
+	if image := spec.Containers[0].Image; image != "registry.local/alpine:3.19@sha256:abc" {
+		t.Fatalf("expected digest pinned image got %s", image)
+	}
+	if len(spec.ImagePullSecrets) != 1 || spec.ImagePullSecrets[0].Name != "pull-secret" {
+		t.Fatalf("expected image pull secret got %#v", spec.ImagePullSecrets)
+	}
+	if job.Namespace != "migration" || spec.ServiceAccountName != "custom-sa" {
+		t.Fatalf("expected job in namespace migration with service account custom-sa got %s and %s", job.Namespace, spec.ServiceAccountName)
+	}
+	if spec.PriorityClassName != "custom" || spec.Priority != nil {
+		t.Fatalf("expected priority class custom without priority value got %s and %v", spec.PriorityClassName, spec.Priority)
+	}
+	if *job.Spec.ActiveDeadlineSeconds != 60 || *job.Spec.BackoffLimit != runCommandBackoffLimit {
+		t.Fatalf("expected deadline 60 and default backoff limit got %d and %d", *job.Spec.ActiveDeadlineSeconds, *job.Spec.BackoffLimit)
+	}
+	if cpu := spec.Containers[0].Resources.Limits[v1.ResourceCPU]; cpu.String() != "50m" {
+		t.Fatalf("expected default cpu limit 50m got %s", cpu.String())
+	}
+}
+
+func Test_buildConfigMapFile_Files(t *testing.T) {
+	paths, secret := buildFilesSecret(map[string][]byte{
+		"/etc/kubernetes/ssl/etcd/issued/peer-key.pem": []byte("peer key"),
+		"/etc/kubernetes/ssl/etcd/issued/peer-crt.pem": []byte("peer cert"),
+	})
+	if string(secret.Data["file-0"]) != "peer cert" || string(secret.Data["file-1"]) != "peer key" {
+		t.Fatalf("expected files ordered by path got %v", secret.Data)
+	}
+
+	script := buildConfigMapFile(paths, []string{"systemctl start etcd3.service"}).Data["command.sh"]
+	expected := "set +x\n" +
+		"install -D -m 0600 /files/file-0 /proc/1/root/etc/kubernetes/ssl/etcd/issued/peer-crt.pem\n" +
+		"install -D -m 0600 /files/file-1 /proc/1/root/etc/kubernetes/ssl/etcd/issued/peer-key.pem\n" +
+		"set -x\n" +
+		nsenterCommand + "systemctl start etcd3.service\n"
+	if !strings.HasSuffix(script, expected) {
+		t.Fatalf("expected script to end with\n%s\ngot\n%s", expected, script)
+	}
+	if strings.Contains(script, "peer key") {
+		t.Fatalf("expected no file content in script\n%s", script)
+	}
+
+	job := buildCommandJob(&v1.Node{}, CommandJobConfig{}.withDefaults("quay.io"), true)
+	volumes := job.Spec.Template.Spec.Volumes
+	if len(volumes) != 2 || volumes[1].Secret == nil || volumes[1].Secret.SecretName != runCommandSecret {
+		t.Fatalf("expected secret volume got %#v", volumes)
+	}
+
+	_, secret = buildFilesSecret(nil)
+	if secret != nil {
+		t.Fatalf("expected no secret without files got %#v", secret)
+	}
+}
+
+func Test_mergePodTemplate(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name: "node-1",
+		},
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{
+				{Key: "node-role.kubernetes.io/control-plane", Effect: v1.TaintEffectNoSchedule},
+			},
+		},
+	}
+	job := buildCommandJob(node, CommandJobConfig{}.withDefaults("quay.io"), false)
+
+	override, err := ParsePodTemplate([]byte(`
+metadata:
+  labels:
+    team: platform
+spec:
+  containers:
+  - name: run-command
+    resources:
+      limits:
+        memory: 100Mi
+  tolerations:
+  - key: dedicated
+    operator: Exists
+`))
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	merged, err := mergePodTemplate(job.Spec.Template, *override)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	if merged.Labels["team"] != "platform" {
+		t.Fatalf("expected label from override got %v", merged.Labels)
+	}
+	if len(merged.Spec.Containers) != 1 {
+		t.Fatalf("expected containers to be merged by name got %d", len(merged.Spec.Containers))
+	}
+	container := merged.Spec.Containers[0]
+	if memory := container.Resources.Limits[v1.ResourceMemory]; memory.String() != "100Mi" {
+		t.Fatalf("expected memory limit from override got %s", memory.String())
+	}
+	if cpu := container.Resources.Limits[v1.ResourceCPU]; cpu.String() != "50m" {
+		t.Fatalf("expected cpu limit to be kept got %s", cpu.String())
+	}
+	if container.Image != job.Spec.Template.Spec.Containers[0].Image || len(container.Command) == 0 {
+		t.Fatalf("expected generated container settings to be kept got %#v", container)
+	}
+	// tolerations have no merge key, so they are replaced
+	if len(merged.Spec.Tolerations) != 1 || merged.Spec.Tolerations[0].Key != "dedicated" {
+		t.Fatalf("expected override tolerations got %#v", merged.Spec.Tolerations)
+	}
+	if merged.Spec.NodeSelector["kubernetes.io/hostname"] != node.Name {
+		t.Fatalf("expected node selector to be kept got %v", merged.Spec.NodeSelector)
+	}
+
+	_, err = ParsePodTemplate([]byte("spec:\n  unknownField: true\n"))
+	if !IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error got %#v", err)
+	}
+}
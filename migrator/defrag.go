@@ -0,0 +1,108 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultCompactRetention is the number of revisions kept when the etcd
+	// history is compacted, so that watches of the Kubernetes API which
+	// fell behind a little can resume.
+	defaultCompactRetention = 1000
+
+	// defragmentTimeout bounds compacting and defragmenting the first
+	// member, which blocks its reads and writes while the database is
+	// rewritten.
+	defragmentTimeout = time.Minute * 10
+)
+
+// compactAndDefragment compacts the etcd history up to the configured
+// retention and defragments the database of the first member, running on
+// the given node, so that members added afterwards receive a smaller
+// snapshot. A NOSPACE alarm the first member raised because its database
+// exceeded the quota is cleared once the database got defragmented.
+//
+// It must only run while the etcd cluster has a single member, as every
+// member has to be defragmented on its own and is blocked meanwhile.
+func (m *Migrator) compactAndDefragment(ctx context.Context, nodeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, defragmentTimeout)
+	defer cancel()
+
+	before, err := m.clientStatus(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	endpoint := m.etcdClient.Endpoints()[0]
+
+	if m.compactRetention >= 0 {
+		rev := before.Header.Revision - m.compactRetention
+		if rev > 0 {
+			// the compaction is physical so that the defragmentation
+			// releases the space of the compacted revisions
+			_, err = m.etcdClient.Compact(ctx, rev, etcdclientv3.WithCompactPhysical())
+			if err == rpctypes.ErrCompacted {
+				m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd history is already compacted beyond revision %d", rev), "step", phaseDefragment)
+			} else if err != nil {
+				return microerror.Mask(err)
+			} else {
+				m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("compacted etcd history to revision %d, keeping %d revisions", rev, m.compactRetention), "step", phaseDefragment)
+			}
+		}
+	}
+
+	_, err = m.etcdClient.Defragment(ctx, endpoint)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	after, err := m.clientStatus(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("defragmented etcd database from %s to %s", formatBytes(before.DbSize), formatBytes(after.DbSize)), "step", phaseDefragment, "node", nodeName)
+	m.recordNodeEvent(nodeName, apiv1.EventTypeNormal, eventReasonDefragmented, "defragmented etcd database from %s to %s", formatBytes(before.DbSize), formatBytes(after.DbSize))
+
+	err = m.disarmNoSpaceAlarms(ctx, after.Header.MemberId)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// disarmNoSpaceAlarms clears the NOSPACE alarms of the given member, whose
+// database got defragmented. The alarms of other members, whose databases
+// were not shrunk, and other alarms, like a corrupted database, are left for
+// an operator.
+func (m *Migrator) disarmNoSpaceAlarms(ctx context.Context, memberID uint64) error {
+	resp, err := m.etcdClient.AlarmList(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	for _, a := range resp.Alarms {
+		if a.Alarm != etcdserver.AlarmType_NOSPACE {
+			continue
+		}
+		if a.MemberID != memberID {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("keeping NOSPACE alarm of member %x, which was not defragmented", a.MemberID), "step", phaseDefragment)
+			continue
+		}
+
+		_, err = m.etcdClient.AlarmDisarm(ctx, &etcdclientv3.AlarmMember{MemberID: a.MemberID, Alarm: a.Alarm})
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("cleared NOSPACE alarm of member %x", a.MemberID), "step", phaseDefragment)
+	}
+
+	return nil
+}
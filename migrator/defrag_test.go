@@ -0,0 +1,178 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_Migrator_Run_Defragment(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	var firstRev int64
+	for i := 0; i < 50; i++ {
+		resp, err := h.etcdClient.Put(context.Background(), "/registry/test", fmt.Sprintf("value-%d", i))
+		if err != nil {
+			t.Fatalf("expected nil got %#v", err)
+		}
+		if i == 0 {
+			firstRev = resp.Header.Revision
+		}
+	}
+
+	c := h.migratorConfig()
+	c.Defragment = true
+	c.CompactRetention = 10
+
+	err := h.newMigratorWithConfig(c).Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	_, err = h.etcdClient.Get(context.Background(), "/registry/test", etcdclientv3.WithRev(firstRev))
+	if err != rpctypes.ErrCompacted {
+		t.Fatalf("expected revision %d to be compacted got %#v", firstRev, err)
+	}
+
+	events := h.events()
+	if !contains(events, eventReasonDefragmented) {
+		t.Fatalf("expected event %s in %v", eventReasonDefragmented, events)
+	}
+}
+
+func Test_Migrator_compactAndDefragment(t *testing.T) {
+	testCases := []struct {
+		name             string
+		revision         int64
+		compactRetention int64
+		compactErr       error
+		expectedCompact  int64
+	}{
+		{
+			name:             "case 0: compact keeping retention",
+			revision:         5000,
+			compactRetention: 1000,
+			expectedCompact:  4000,
+		},
+		{
+			name:             "case 1: history shorter than retention",
+			revision:         500,
+			compactRetention: 1000,
+		},
+		{
+			name:             "case 2: compaction disabled",
+			revision:         5000,
+			compactRetention: -1,
+		},
+		{
+			name:             "case 3: already compacted",
+			revision:         5000,
+			compactRetention: 1000,
+			compactErr:       rpctypes.ErrCompacted,
+			expectedCompact:  4000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &testDefragClient{
+				alarms: []*etcdserver.AlarmMember{
+					{MemberID: 1, Alarm: etcdserver.AlarmType_NOSPACE},
+					{MemberID: 1, Alarm: etcdserver.AlarmType_CORRUPT},
+					{MemberID: 2, Alarm: etcdserver.AlarmType_NOSPACE},
+				},
+				compactErr: tc.compactErr,
+				dbSize:     1000,
+				revision:   tc.revision,
+			}
+			m := &Migrator{
+				compactRetention: tc.compactRetention,
+
+				etcdClient:    c,
+				eventRecorder: record.NewFakeRecorder(10),
+				logger:        microloggertest.New(),
+			}
+
+			err := m.compactAndDefragment(context.Background(), "master-1")
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+			if c.compacted != tc.expectedCompact {
+				t.Fatalf("compacted revision == %d, want %d", c.compacted, tc.expectedCompact)
+			}
+			if !c.defragmented {
+				t.Fatalf("expected database to be defragmented")
+			}
+			// only the NOSPACE alarm of the defragmented member is cleared
+			if len(c.alarms) != 2 || c.alarms[0].Alarm != etcdserver.AlarmType_CORRUPT || c.alarms[1].MemberID != 2 {
+				t.Fatalf("expected CORRUPT alarm and NOSPACE alarm of member 2 to be left got %v", c.alarms)
+			}
+		})
+	}
+}
+
+// testDefragClient records compaction, defragmentation and disarmed alarms of
+// a single member. Defragmenting halves the database size.
+type testDefragClient struct {
+	EtcdClient
+
+	alarms       []*etcdserver.AlarmMember
+	compactErr   error
+	compacted    int64
+	dbSize       int64
+	defragmented bool
+	revision     int64
+}
+
+func (c *testDefragClient) Endpoints() []string {
+	return []string{"127.0.0.1:2379"}
+}
+
+func (c *testDefragClient) Status(ctx context.Context, endpoint string) (*etcdclientv3.StatusResponse, error) {
+	s := testStatus(1, 1, 1)
+	s.Header.Revision = c.revision
+	s.DbSize = c.dbSize
+
+	return s, nil
+}
+
+func (c *testDefragClient) Compact(ctx context.Context, rev int64, opts ...etcdclientv3.CompactOption) (*etcdclientv3.CompactResponse, error) {
+	c.compacted = rev
+	if c.compactErr != nil {
+		return nil, c.compactErr
+	}
+
+	return &etcdclientv3.CompactResponse{}, nil
+}
+
+func (c *testDefragClient) Defragment(ctx context.Context, endpoint string) (*etcdclientv3.DefragmentResponse, error) {
+	c.defragmented = true
+	c.dbSize /= 2
+
+	return &etcdclientv3.DefragmentResponse{}, nil
+}
+
+func (c *testDefragClient) AlarmList(ctx context.Context) (*etcdclientv3.AlarmResponse, error) {
+	return &etcdclientv3.AlarmResponse{Alarms: c.alarms}, nil
+}
+
+func (c *testDefragClient) AlarmDisarm(ctx context.Context, am *etcdclientv3.AlarmMember) (*etcdclientv3.AlarmResponse, error) {
+	var alarms []*etcdserver.AlarmMember
+	for _, a := range c.alarms {
+		if a.MemberID != am.MemberID || a.Alarm != am.Alarm {
+			alarms = append(alarms, a)
+		}
+	}
+	c.alarms = alarms
+
+	return &etcdclientv3.AlarmResponse{}, nil
+}
@@ -0,0 +1,168 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+)
+
+const (
+	// defaultDiskSpaceFactor is the multiple of the etcd database size which
+	// must be free on a node, as a joining member receives a snapshot of
+	// the database besides writing its own copy.
+	defaultDiskSpaceFactor = 2
+	// defaultFsyncLatencyLimit follows the etcd recommendation for the 99th
+	// percentile of the WAL fsync duration.
+	defaultFsyncLatencyLimit = time.Millisecond * 10
+
+	// etcdDataDir is the etcd data directory on the master nodes.
+	etcdDataDir = "/var/lib/etcd"
+	// fsyncProbeSamples is the number of synchronous writes of the fsync
+	// probe.
+	fsyncProbeSamples = 100
+	// fsyncProbeSize is the size in bytes of a synchronous write of the
+	// fsync probe, about the size of an etcd WAL entry.
+	fsyncProbeSize = 2300
+
+	diskAvailableMarker = "### etcd-cluster-migrator disk-available "
+	fsyncMarker         = "### etcd-cluster-migrator fsync "
+)
+
+// checkNodeDisk checks that the filesystem of the etcd data directory on the
+// given node has room for the configured multiple of the etcd database size
+// and that its fsync latency is below the configured limit.
+//
+// The results are read through the NodeCommandRunner, so the check is
+// skipped when it can not return the command output. The latency of a
+// synchronous write is measured from the shell, so it includes the time to
+// start dd and is an upper bound.
+func (m *Migrator) checkNodeDisk(ctx context.Context, nodeName string) error {
+	checkSpace := m.diskSpaceFactor > 0
+	checkFsync := m.fsyncLatencyLimit > 0
+	if !checkSpace && !checkFsync {
+		return nil
+	}
+
+	runner, ok := m.commandRunner.(NodeCommandOutputRunner)
+	if !ok {
+		m.logger.LogCtx(ctx, "level", "warning", "message", "node command runner does not return output, skipping disk check", "step", phaseCheckDisk, "node", nodeName)
+		return nil
+	}
+
+	var dbSize int64
+	if checkSpace {
+		s, err := m.clientStatus(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		dbSize = s.DbSize
+	}
+
+	output, err := runner.RunCommandsWithOutput(ctx, nodeName, diskCommands(checkSpace, checkFsync))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	available, latencies := parseDiskOutput(output)
+
+	if checkSpace {
+		if available < 0 {
+			return microerror.Maskf(preflightFailedError, "failed to read free space of %s on node %s", etcdDataDir, nodeName)
+		}
+
+		required := int64(float64(dbSize) * m.diskSpaceFactor)
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("%s has %s free, the etcd database has %s", etcdDataDir, formatBytes(available), formatBytes(dbSize)), "step", phaseCheckDisk, "node", nodeName)
+		if available < required {
+			return microerror.Maskf(preflightFailedError, "%s on node %s has %s free but needs %s, %.1f times the etcd database size of %s", etcdDataDir, nodeName, formatBytes(available), formatBytes(required), m.diskSpaceFactor, formatBytes(dbSize))
+		}
+	}
+
+	if checkFsync {
+		if len(latencies) < fsyncProbeSamples {
+			return microerror.Maskf(preflightFailedError, "failed to probe fsync latency of %s on node %s, %d of %d synchronous writes succeeded", etcdDataDir, nodeName, len(latencies), fsyncProbeSamples)
+		}
+
+		p99 := percentile(latencies, 0.99)
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("fsync latency of %s is %s at the 99th percentile of %d writes", etcdDataDir, p99, len(latencies)), "step", phaseCheckDisk, "node", nodeName)
+		if p99 > m.fsyncLatencyLimit {
+			return microerror.Maskf(preflightFailedError, "fsync latency of %s on node %s is %s at the 99th percentile, more than %s", etcdDataDir, nodeName, p99, m.fsyncLatencyLimit)
+		}
+	}
+
+	return nil
+}
+
+// diskCommands returns the commands printing the free space in bytes of the
+// filesystem of the etcd data directory and the duration in nanoseconds of
+// synchronous writes to it. Nothing is printed for a failed df or dd, so
+// that a missing or read-only data directory is not mistaken for a fast
+// disk.
+func diskCommands(checkSpace bool, checkFsync bool) []string {
+	var commands []string
+	if checkSpace {
+		commands = append(commands,
+			fmt.Sprintf(`sh -c 'a=$(df -Pk %s | tail -n 1 | awk "{print \$4}"); case "$a" in ""|*[!0-9]*) ;; *) echo "%s$((a * 1024))" ;; esac'`, etcdDataDir, diskAvailableMarker),
+		)
+	}
+	if checkFsync {
+		probeFile := fmt.Sprintf("%s/.etcd-cluster-migrator-fsync", etcdDataDir)
+		commands = append(commands,
+			fmt.Sprintf(`sh -c 'for i in $(seq %d); do s=$(date +%%s%%N); if dd if=/dev/zero of=%s bs=%d count=1 oflag=dsync conv=notrunc 2>/dev/null; then e=$(date +%%s%%N); echo "%s$((e-s))"; fi; done'`, fsyncProbeSamples, probeFile, fsyncProbeSize, fsyncMarker),
+			fmt.Sprintf("rm -f %s", probeFile),
+		)
+	}
+
+	return commands
+}
+
+// parseDiskOutput returns the free space and the fsync latencies printed by
+// diskCommands. The free space is -1 when it was not printed.
+func parseDiskOutput(output []byte) (int64, []time.Duration) {
+	available := int64(-1)
+	var latencies []time.Duration
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, diskAvailableMarker):
+			v, err := strconv.ParseInt(strings.TrimPrefix(line, diskAvailableMarker), 10, 64)
+			if err == nil {
+				available = v
+			}
+		case strings.HasPrefix(line, fsyncMarker):
+			v, err := strconv.ParseInt(strings.TrimPrefix(line, fsyncMarker), 10, 64)
+			if err == nil && v >= 0 {
+				latencies = append(latencies, time.Duration(v))
+			}
+		}
+	}
+
+	return available, latencies
+}
+
+// percentile returns the given percentile of the latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+
+	return sorted[i]
+}
+
+// formatBytes returns the given size in MiB.
+func formatBytes(b int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(b)/(1024*1024))
+}
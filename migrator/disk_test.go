@@ -0,0 +1,182 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_Migrator_checkNodeDisk(t *testing.T) {
+	testCases := []struct {
+		name              string
+		dbSize            int64
+		available         int64
+		latencies         []time.Duration
+		diskSpaceFactor   float64
+		fsyncLatencyLimit time.Duration
+		errorMatcher      func(error) bool
+	}{
+		{
+			name:              "case 0: enough space and fast disk",
+			dbSize:            100,
+			available:         200,
+			latencies:         testLatencies(100, time.Millisecond),
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+		},
+		{
+			name:              "case 1: not enough space",
+			dbSize:            100,
+			available:         199,
+			latencies:         testLatencies(100, time.Millisecond),
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+			errorMatcher:      IsPreflightFailed,
+		},
+		{
+			name:              "case 2: slow disk",
+			dbSize:            100,
+			available:         200,
+			latencies:         append(testLatencies(98, time.Millisecond), time.Millisecond*20, time.Millisecond*20),
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+			errorMatcher:      IsPreflightFailed,
+		},
+		{
+			name:              "case 3: a single slow write is above the 99th percentile",
+			dbSize:            100,
+			available:         200,
+			latencies:         append(testLatencies(99, time.Millisecond), time.Second),
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+		},
+		{
+			name:              "case 4: space check disabled",
+			dbSize:            100,
+			available:         0,
+			latencies:         testLatencies(100, time.Millisecond),
+			diskSpaceFactor:   -1,
+			fsyncLatencyLimit: time.Millisecond * 10,
+		},
+		{
+			name:              "case 5: failed synchronous writes",
+			dbSize:            100,
+			available:         200,
+			latencies:         testLatencies(50, time.Millisecond),
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+			errorMatcher:      IsPreflightFailed,
+		},
+		{
+			name:              "case 6: no fsync output",
+			dbSize:            100,
+			available:         200,
+			diskSpaceFactor:   2,
+			fsyncLatencyLimit: time.Millisecond * 10,
+			errorMatcher:      IsPreflightFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			status := testStatus(1, 1, 1)
+			status.DbSize = tc.dbSize
+
+			r := &testDiskRunner{
+				available: tc.available,
+				latencies: tc.latencies,
+			}
+			m := &Migrator{
+				diskSpaceFactor:   tc.diskSpaceFactor,
+				fsyncLatencyLimit: tc.fsyncLatencyLimit,
+
+				commandRunner: r,
+				etcdClient: &testEndpointsClient{
+					EtcdClient: &testStatusClient{statuses: map[string]*etcdclientv3.StatusResponse{"127.0.0.1:2379": status}},
+					endpoints:  []string{"127.0.0.1:2379"},
+				},
+				logger: microloggertest.New(),
+			}
+
+			err := m.checkNodeDisk(context.Background(), "master-2")
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_parseDiskOutput(t *testing.T) {
+	output := "+ nsenter -t 1 -m -u -n -i -- sh -c 'echo ...'\n" +
+		"### etcd-cluster-migrator disk-available 1048576\n" +
+		"### etcd-cluster-migrator fsync 1500000\n" +
+		"### etcd-cluster-migrator fsync invalid\n" +
+		"### etcd-cluster-migrator fsync 2500000\n"
+
+	available, latencies := parseDiskOutput([]byte(output))
+	if available != 1048576 {
+		t.Fatalf("available == %d, want 1048576", available)
+	}
+	expected := []time.Duration{time.Microsecond * 1500, time.Microsecond * 2500}
+	if fmt.Sprint(latencies) != fmt.Sprint(expected) {
+		t.Fatalf("latencies == %v, want %v", latencies, expected)
+	}
+
+	available, latencies = parseDiskOutput([]byte("fake logs"))
+	if available != -1 || len(latencies) != 0 {
+		t.Fatalf("expected no results got %d and %v", available, latencies)
+	}
+}
+
+// testDiskRunner prints the output of diskCommands with the given free space
+// and fsync latencies.
+type testDiskRunner struct {
+	available int64
+	latencies []time.Duration
+}
+
+func (r *testDiskRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	return nil
+}
+
+func (r *testDiskRunner) RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%d\n", diskAvailableMarker, r.available)
+	for _, l := range r.latencies {
+		fmt.Fprintf(&b, "%s%d\n", fsyncMarker, l.Nanoseconds())
+	}
+
+	return []byte(b.String()), nil
+}
+
+// testEndpointsClient returns the given endpoints.
+type testEndpointsClient struct {
+	EtcdClient
+	endpoints []string
+}
+
+func (c *testEndpointsClient) Endpoints() []string {
+	return c.endpoints
+}
+
+func testLatencies(n int, latency time.Duration) []time.Duration {
+	var latencies []time.Duration
+	for i := 0; i < n; i++ {
+		latencies = append(latencies, latency)
+	}
+
+	return latencies
+}
@@ -19,3 +19,57 @@ var invalidConfigError = &microerror.Error{
 func IsInvalidConfig(err error) bool {
 	return microerror.Cause(err) == invalidConfigError
 }
+
+var lockHeldError = &microerror.Error{
+	Kind: "lockHeldError",
+}
+
+// IsLockHeld asserts lockHeldError.
+func IsLockHeld(err error) bool {
+	return microerror.Cause(err) == lockHeldError
+}
+
+var preflightFailedError = &microerror.Error{
+	Kind: "preflightFailedError",
+}
+
+// IsPreflightFailed asserts preflightFailedError.
+func IsPreflightFailed(err error) bool {
+	return microerror.Cause(err) == preflightFailedError
+}
+
+var quorumLostError = &microerror.Error{
+	Kind: "quorumLostError",
+}
+
+// IsQuorumLost asserts quorumLostError.
+func IsQuorumLost(err error) bool {
+	return microerror.Cause(err) == quorumLostError
+}
+
+var quorumRiskError = &microerror.Error{
+	Kind: "quorumRiskError",
+}
+
+// IsQuorumRisk asserts quorumRiskError.
+func IsQuorumRisk(err error) bool {
+	return microerror.Cause(err) == quorumRiskError
+}
+
+var rollbackPerformedError = &microerror.Error{
+	Kind: "rollbackPerformedError",
+}
+
+// IsRollbackPerformed asserts rollbackPerformedError.
+func IsRollbackPerformed(err error) bool {
+	return microerror.Cause(err) == rollbackPerformedError
+}
+
+var timeoutError = &microerror.Error{
+	Kind: "timeoutError",
+}
+
+// IsTimeout asserts timeoutError.
+func IsTimeout(err error) bool {
+	return microerror.Cause(err) == timeoutError
+}
@@ -1,18 +1,37 @@
 package migrator
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/giantswarm/microerror"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
 	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	apiv1 "k8s.io/api/core/v1"
 )
 
 const (
 	dialTimeout = time.Minute
+
+	etcdServiceFile = "/etc/systemd/system/etcd3.service"
 )
 
+// EtcdClient is the part of the etcd client the migrator uses. It is
+// implemented by *etcdclientv3.Client.
+type EtcdClient interface {
+	etcdclientv3.Cluster
+	etcdclientv3.Maintenance
+
+	// Compact is the only key-value request of the migrator, compacting the
+	// etcd history before members are added.
+	Compact(ctx context.Context, rev int64, opts ...etcdclientv3.CompactOption) (*etcdclientv3.CompactResponse, error)
+	Close() error
+	Endpoints() []string
+}
+
 func createEtcdClient(caFile string, certFile string, keyFile string, endpoint string) (*etcdclientv3.Client, error) {
 	etcdCertPair, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
@@ -47,8 +66,99 @@ func createEtcdClient(caFile string, certFile string, keyFile string, endpoint s
 	return client, nil
 }
 
+// etcdHost returns the DNS name of the member with the given index.
+func etcdHost(index int, baseDomain string) string {
+	return fmt.Sprintf("etcd%d.%s", index, baseDomain)
+}
+
+func etcdClientURL(index int, baseDomain string) string {
+	return fmt.Sprintf("https://%s:2379", etcdHost(index, baseDomain))
+}
+
 func etcdPeerName(index int, baseDomain string) string {
-	return fmt.Sprintf("https://etcd%d.%s:2380", index, baseDomain)
+	return fmt.Sprintf("https://%s:2380", etcdHost(index, baseDomain))
+}
+
+// hasPeerURL returns true if the given member advertises the given peer URL.
+func hasPeerURL(member *etcdserver.Member, peerURL string) bool {
+	for _, u := range member.PeerURLs {
+		if u == peerURL {
+			return true
+		}
+	}
+	return false
+}
+
+// findMember returns the member advertising the given peer URL or nil if
+// there is none.
+func findMember(members []*etcdserver.Member, peerURL string) *etcdserver.Member {
+	for _, member := range members {
+		if hasPeerURL(member, peerURL) {
+			return member
+		}
+	}
+	return nil
+}
+
+// allStarted returns true if all given members have started. Members which
+// have been added but not started yet have no name.
+func allStarted(members []*etcdserver.Member) bool {
+	for _, member := range members {
+		if member.Name == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeClientURLs returns the etcd client URLs on the internal IPs of the
+// given node.
+func nodeClientURLs(node *apiv1.Node) []string {
+	var urls []string
+	for _, a := range node.Status.Addresses {
+		if a.Type == apiv1.NodeInternalIP {
+			urls = append(urls, fmt.Sprintf("https://%s", net.JoinHostPort(a.Address, "2379")))
+		}
+	}
+
+	return urls
+}
+
+// configureNodeCommands returns the commands configuring the etcd3 service of
+// a node to join the etcd cluster with the given number of members. The
+// existing data directory and service file are moved to the given backup
+// directory first. When certificates are given, the etcd3 service is pointed
+// to them and the files to write to the node before are returned.
+func configureNodeCommands(startingIndex int, baseDomain string, nodeCount int, backupPath string, certs *memberCertificates) ([]string, map[string][]byte) {
+	commands := []string{
+		"systemctl stop etcd3", // stop etcd3 service
+	}
+	// ensure the data folder is empty
+	commands = append(commands, backupNodeCommands(backupPath)...)
+	var files map[string][]byte
+	if certs != nil {
+		var certCommands []string
+		files, certCommands = installCertificatesFiles(certs)
+		commands = append(commands, certCommands...)
+	}
+
+	return append(commands,
+		// sed command to properly set initialCluster string
+		sedInitialClusterCommand(initialCluster(startingIndex, baseDomain, nodeCount)),
+		"systemctl daemon-reload",       // load new etcd3 service file
+		"systemctl start etcd3.service", // restart etcd3, after this etcd3 will start syncing data from the cluster
+	), files
+}
+
+// sedInitialClusterCommand returns the sed command replacing the initial
+// cluster flag of the etcd3 service with the given flags. The final sed
+// command may look like this:
+// sed -i 's/--initial-cluster .*\\/--initial-cluster etcd1=https://etcd1.clusterd.domain.io:2380,etcd1=https://etcd2.clusterd.domain.io:2380/g' /etc/systemd/system/etcd3.service'
+func sedInitialClusterCommand(replacement string) string {
+	sedReplaceRegEx := "--initial-cluster .*\\\\"
+	sedReplaceWith := fmt.Sprintf("--initial-cluster %s\\\\", replacement)
+
+	return fmt.Sprintf("sed -i 's/%s/%s/g' %s", sedReplaceRegEx, sedReplaceWith, etcdServiceFile)
 }
 
 func initialCluster(startingIndex int, baseDomain string, nodesCount int) string {
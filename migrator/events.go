@@ -0,0 +1,90 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/giantswarm/microerror"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/giantswarm/etcd-cluster-migrator/pkg/project"
+)
+
+const (
+	eventReasonPeerURLFixed    = "EtcdPeerURLFixed"
+	eventReasonNodeConfigured  = "EtcdNodeConfigured"
+	eventReasonMemberAdded     = "EtcdMemberAdded"
+	eventReasonSyncComplete    = "EtcdSyncComplete"
+	eventReasonStepFailed      = "EtcdMigrationStepFailed"
+	eventReasonMigrationDone   = "EtcdMigrationSucceeded"
+	eventReasonMigrationFailed = "EtcdMigrationFailed"
+	eventReasonRecovered       = "EtcdQuorumRecovery"
+	eventReasonBackupRemoved   = "EtcdBackupRemoved"
+	eventReasonHostsInstalled  = "EtcdHostsInstalled"
+	eventReasonHostsRemoved    = "EtcdHostsRemoved"
+	eventReasonDefragmented    = "EtcdDefragmented"
+)
+
+// newEventRecorder returns an event recorder writing events through the
+// given client and a function flushing and stopping the underlying
+// broadcaster.
+func newEventRecorder(c kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.CoreV1().Events("")})
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: project.Name()})
+
+	return recorder, broadcaster.Shutdown
+}
+
+// nodeReference returns the object reference events for the given node are
+// recorded against. The UID is set to the node name the same way the kubelet
+// does it, so that the events show up in `kubectl describe node`.
+func nodeReference(nodeName string) *apiv1.ObjectReference {
+	return &apiv1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       nodeName,
+		UID:        types.UID(nodeName),
+	}
+}
+
+// recordNodeEvent records an event against the given master node and the
+// migrator's own Job.
+func (m *Migrator) recordNodeEvent(nodeName string, eventType string, reason string, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+
+	m.eventRecorder.Event(nodeReference(nodeName), eventType, reason, message)
+	m.recordJobEvent(eventType, reason, "node %s: %s", nodeName, message)
+}
+
+// recordJobEvent records an event against the migrator's own Job, if it is
+// known.
+func (m *Migrator) recordJobEvent(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if m.job == nil {
+		return
+	}
+	m.eventRecorder.Eventf(m.job, eventType, reason, messageFmt, args...)
+}
+
+// lookupJob fetches the migrator's own Job so events can be recorded against
+// it. Nothing is looked up when the Job name is not configured.
+func (m *Migrator) lookupJob(ctx context.Context) (runtime.Object, error) {
+	if m.jobName == "" {
+		return nil, nil
+	}
+
+	job, err := m.k8sClient.BatchV1().Jobs(m.jobNamespace).Get(ctx, m.jobName, metav1.GetOptions{})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return job, nil
+}
@@ -0,0 +1,724 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdversion "go.etcd.io/etcd/api/v3/version"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+	batchapiv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	restclient "k8s.io/client-go/rest"
+	fakerest "k8s.io/client-go/rest/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testBaseDomain  = "cluster.test"
+	testMemberCount = 3
+
+	testMemberStartTimeout = time.Second * 30
+
+	maxTestPort = 32000
+)
+
+var (
+	portMutex sync.Mutex
+	nextPort  = 20000 + rand.Intn(10000)
+)
+
+// testHarness runs in-process etcd members and a fake Kubernetes clientset.
+// Creating a run-command job starting etcd3 on a master node simulates the
+// node script by starting the embedded etcd member of that node as soon as it has been
+// added to the etcd cluster, the same way systemd keeps restarting etcd3
+// until the member is registered. The succeeded pod of the job logs the
+// output of a healthy node for the preflight checks.
+type testHarness struct {
+	t *testing.T
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	dir    string
+
+	clientURLs map[int]url.URL
+	peerURLs   map[int]url.URL
+
+	etcdClient *etcdclientv3.Client
+	k8sClient  *fake.Clientset
+	recorder   *record.FakeRecorder
+
+	mutex sync.Mutex
+	// failJobs contains the node names for which creating the run-command
+	// job starting etcd3 fails.
+	failJobs map[string]bool
+	// joining contains the indexes of the members which are being started.
+	joining map[int]bool
+	// jobs contains the run-command jobs created so far.
+	jobs []testJob
+	// logs contains the simulated log of the run-command pods by name.
+	logs    map[string]string
+	members map[int]*embed.Etcd
+	wg      sync.WaitGroup
+}
+
+// newTestHarness starts an etcd cluster with the given number of started
+// members. The first member advertises a localhost peer URL like clusters
+// created by older versions of k8scloudconfig.
+func newTestHarness(t *testing.T, startedMembers int) *testHarness {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &testHarness{
+		t: t,
+
+		ctx:    ctx,
+		cancel: cancel,
+		dir:    t.TempDir(),
+
+		clientURLs: map[int]url.URL{},
+		peerURLs:   map[int]url.URL{},
+
+		recorder: record.NewFakeRecorder(1000),
+
+		failJobs: map[string]bool{},
+		joining:  map[int]bool{},
+		logs:     map[string]string{},
+		members:  map[int]*embed.Etcd{},
+	}
+
+	t.Cleanup(func() {
+		h.cancel()
+		h.wg.Wait()
+		if h.etcdClient != nil {
+			h.etcdClient.Close()
+		}
+		h.mutex.Lock()
+		for _, e := range h.members {
+			e.Close()
+		}
+		h.mutex.Unlock()
+	})
+
+	for i := 1; i <= testMemberCount; i++ {
+		h.clientURLs[i] = freeURL(t)
+		h.peerURLs[i] = freeURL(t)
+	}
+
+	// start the first member with the legacy localhost peer URL
+	{
+		legacyPeerURL := h.peerURLs[1]
+		legacyPeerURL.Host = "localhost:" + legacyPeerURL.Port()
+		err := h.startMember(1, fmt.Sprintf("etcd1=%s", legacyPeerURL.String()), embed.ClusterStateFlagNew, legacyPeerURL)
+		if err != nil {
+			t.Fatalf("failed to start first member: %#v", err)
+		}
+
+		c, err := etcdclientv3.New(etcdclientv3.Config{
+			Endpoints:   []string{h.clientURL(1)},
+			DialTimeout: time.Second * 5,
+			Logger:      zap.NewNop(),
+		})
+		if err != nil {
+			t.Fatalf("failed to create etcd client: %#v", err)
+		}
+		h.etcdClient = c
+	}
+
+	for i := 2; i <= startedMembers; i++ {
+		if i == 2 {
+			_, err := h.etcdClient.MemberUpdate(ctx, h.memberID(1), []string{h.peerURL(1)})
+			if err != nil {
+				t.Fatalf("failed to update first member: %#v", err)
+			}
+		}
+		h.addMember(i)
+		h.joinMember(i)
+	}
+
+	h.k8sClient = fake.NewSimpleClientset()
+	for i := 1; i <= testMemberCount; i++ {
+		node := &apiv1.Node{
+			ObjectMeta: apismetav1.ObjectMeta{
+				Name: testNodeName(i),
+				Labels: map[string]string{
+					"role":        "master",
+					labelMasterID: strconv.Itoa(i),
+				},
+			},
+			Status: apiv1.NodeStatus{
+				Conditions: []apiv1.NodeCondition{
+					{
+						Type:   apiv1.NodeReady,
+						Status: apiv1.ConditionTrue,
+					},
+				},
+			},
+		}
+		_, err := h.k8sClient.CoreV1().Nodes().Create(ctx, node, apismetav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create node: %#v", err)
+		}
+	}
+	h.k8sClient.PrependReactor("create", "jobs", h.reactJobCreate)
+
+	return h
+}
+
+// addMember adds the member with the given index to the etcd cluster,
+// retrying while the recently started members are not considered healthy.
+func (h *testHarness) addMember(index int) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(testMemberStartTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(h.ctx, time.Second*10)
+		_, err := h.etcdClient.MemberAdd(ctx, []string{h.peerURL(index)})
+		cancel()
+		if err == nil {
+			return
+		} else if err != rpctypes.ErrUnhealthy || time.Now().After(deadline) {
+			h.t.Fatalf("failed to add member %d: %#v", index, err)
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+// newMigrator returns a migrator using the clients of the harness.
+func (h *testHarness) newMigrator() *Migrator {
+	return h.newMigratorWithConfig(h.migratorConfig())
+}
+
+// newMigratorWithRunner returns a migrator using the clients of the harness
+// and the given NodeCommandRunner.
+func (h *testHarness) newMigratorWithRunner(runner NodeCommandRunner) *Migrator {
+	c := h.migratorConfig()
+	c.NodeCommandRunner = runner
+
+	return h.newMigratorWithConfig(c)
+}
+
+// migratorConfig returns the configuration of a migrator using the clients of
+// the harness. The default run-command jobs are used to configure nodes.
+func (h *testHarness) migratorConfig() MigratorConfig {
+	return MigratorConfig{
+		EtcdClient:    h.etcdClient,
+		EventRecorder: h.recorder,
+		K8sClient:     &testClientset{Clientset: h.k8sClient, h: h},
+
+		BaseDomain: testBaseDomain,
+		// the simulated jobs complete right away
+		CommandJob:        CommandJobConfig{PollInterval: time.Millisecond * 10},
+		DockerRegistry:    "quay.io",
+		EtcdStartingIndex: 1,
+		Logger:            microloggertest.New(),
+		MasterNodeLabels:  []string{"role=master"},
+		MemberCount:       testMemberCount,
+	}
+}
+
+func (h *testHarness) newMigratorWithConfig(c MigratorConfig) *Migrator {
+	h.t.Helper()
+
+	m, err := NewMigrator(c)
+	if err != nil {
+		h.t.Fatalf("failed to create migrator: %#v", err)
+	}
+	m.intervals = testIntervals()
+	// the embedded members listen on localhost instead of the etcd DNS names
+	m.etcdClientURL = h.clientURL
+	m.etcdPeerURL = h.peerURL
+	m.nodeClientURLs = h.nodeClientURLs
+
+	return m
+}
+
+// nodeClientURLs returns the client URL of the embedded member with the index
+// of the given node.
+func (h *testHarness) nodeClientURLs(node *apiv1.Node) []string {
+	index, err := strconv.Atoi(strings.TrimPrefix(node.Name, "master-"))
+	if err != nil {
+		return nil
+	}
+	if _, ok := h.clientURLs[index]; !ok {
+		return nil
+	}
+
+	return []string{h.clientURL(index)}
+}
+
+// testIntervals returns the intervals of the migrators of the harness. The
+// embedded etcd members are local, so there is no need to wait long for the
+// data sync or the members to start.
+func testIntervals() intervals {
+	return intervals{
+		apiRetry:        time.Millisecond * 10,
+		apiStart:        time.Millisecond * 10,
+		lockLease:       time.Second * 60,
+		lockRenew:       time.Second * 15,
+		masterNodeFetch: time.Millisecond * 100,
+		memberAddRetry:  time.Second,
+		memberStart:     time.Millisecond * 100,
+	}
+}
+
+// testCommandRunner simulates the node commands on the embedded members
+// instead of executing them.
+type testCommandRunner struct {
+	h         *testHarness
+	nodeNames []string
+	scripts   []string
+}
+
+func (r *testCommandRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	r.nodeNames = append(r.nodeNames, nodeName)
+	r.scripts = append(r.scripts, strings.Join(commands, "\n"))
+
+	index, err := strconv.Atoi(strings.TrimPrefix(nodeName, "master-"))
+	if err != nil {
+		return err
+	}
+
+	script := strings.Join(commands, "\n")
+	switch {
+	case strings.Contains(script, "--force-new-cluster") && strings.Contains(script, "systemctl start"):
+		return r.h.forceNewCluster(index)
+	case strings.Contains(script, "systemctl start"):
+		r.h.wg.Add(1)
+		go func() {
+			defer r.h.wg.Done()
+			r.h.joinMember(index)
+		}()
+	}
+
+	return nil
+}
+
+// failJob makes creating the run-command job starting etcd3 on the given
+// node fail.
+func (h *testHarness) failJob(nodeName string, fail bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.failJobs[nodeName] = fail
+}
+
+func (h *testHarness) reactJobCreate(action k8stesting.Action) (bool, runtime.Object, error) {
+	job := action.(k8stesting.CreateAction).GetObject().(*batchapiv1.Job)
+	nodeName := job.Spec.Template.Spec.NodeSelector["kubernetes.io/hostname"]
+
+	obj, err := h.k8sClient.Tracker().Get(apiv1.SchemeGroupVersion.WithResource("configmaps"), action.GetNamespace(), runCommandConfigMap)
+	if err != nil {
+		return true, nil, err
+	}
+	script := obj.(*apiv1.ConfigMap).Data["command.sh"]
+	configure := strings.Contains(script, "systemctl start")
+
+	var files map[string][]byte
+	obj, err = h.k8sClient.Tracker().Get(apiv1.SchemeGroupVersion.WithResource("secrets"), action.GetNamespace(), runCommandSecret)
+	if err == nil {
+		files = obj.(*apiv1.Secret).Data
+	} else if !k8serrors.IsNotFound(err) {
+		return true, nil, err
+	}
+
+	h.mutex.Lock()
+	fail := h.failJobs[nodeName]
+	h.jobs = append(h.jobs, testJob{script: script, files: files})
+	h.mutex.Unlock()
+	if fail && configure {
+		return true, nil, fmt.Errorf("simulated failure creating job on node %s", nodeName)
+	}
+
+	job.Status.Conditions = append(job.Status.Conditions, batchapiv1.JobCondition{
+		Type:   batchapiv1.JobComplete,
+		Status: apiv1.ConditionTrue,
+	})
+
+	index, err := strconv.Atoi(strings.TrimPrefix(nodeName, "master-"))
+	if err != nil {
+		return true, nil, err
+	}
+
+	err = h.addJobPod(action.GetNamespace(), job.Name, script)
+	if err != nil {
+		return true, nil, err
+	}
+
+	if configure {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.joinMember(index)
+		}()
+	}
+
+	// let the object tracker store the completed job
+	return false, nil, nil
+}
+
+// addJobPod stores the succeeded pod of the run-command job with the given
+// name and its log, simulating the given script on a healthy node. The pod
+// replaces the one of the previous job, as the fake clientset does not
+// delete it along with the job.
+func (h *testHarness) addJobPod(namespace string, jobName string, script string) error {
+	pod := &apiv1.Pod{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"job-name": jobName,
+			},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodSucceeded,
+		},
+	}
+	// the reactor runs while the clientset is locked, so the tracker is
+	// used directly
+	err := h.k8sClient.Tracker().Update(apiv1.SchemeGroupVersion.WithResource("pods"), pod, namespace)
+	if k8serrors.IsNotFound(err) {
+		err = h.k8sClient.Tracker().Add(pod)
+	}
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	h.logs[jobName] = nodeOutput(script, time.Now())
+	h.mutex.Unlock()
+
+	return nil
+}
+
+// podLogs returns the simulated log of the pod with the given name.
+func (h *testHarness) podLogs(name string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.logs[name]
+}
+
+// nodeOutput returns the output of the given script on a healthy node with
+// a synchronized clock, enough free space, a fast disk and an etcd3 service
+// running the etcd version of the embedded members.
+func nodeOutput(script string, now time.Time) string {
+	var b strings.Builder
+	if strings.Contains(script, clockMarker) {
+		fmt.Fprintf(&b, "%s%d.%09d yes\n", clockMarker, now.Unix(), now.Nanosecond())
+		fmt.Fprintf(&b, "%s%s +250us\n", clockMarker, clockSourceTimesyncd)
+	}
+	if strings.Contains(script, diskAvailableMarker) {
+		fmt.Fprintf(&b, "%s%d\n", diskAvailableMarker, int64(1)<<40)
+	}
+	if strings.Contains(script, fsyncMarker) {
+		for i := 0; i < fsyncProbeSamples; i++ {
+			fmt.Fprintf(&b, "%s%d\n", fsyncMarker, time.Millisecond.Nanoseconds())
+		}
+	}
+	if strings.Contains(script, nodeFileBeginMarker+etcdServiceFile) {
+		fmt.Fprintf(&b, "%s%s\n", nodeFileBeginMarker, etcdServiceFile)
+		fmt.Fprintf(&b, "[Service]\nExecStart=/usr/bin/docker run --name etcd3 quay.io/giantswarm/etcd:v%s etcd\n", etcdversion.Version)
+		fmt.Fprintf(&b, "%s\n", nodeFileEndMarker)
+	}
+
+	return b.String()
+}
+
+// testClientset is the fake clientset of the harness returning the simulated
+// logs of the run-command pods, as the fake clientset only returns a fixed
+// text.
+type testClientset struct {
+	*fake.Clientset
+	h *testHarness
+}
+
+func (c *testClientset) CoreV1() corev1client.CoreV1Interface {
+	return &testCoreV1Client{CoreV1Interface: c.Clientset.CoreV1(), h: c.h}
+}
+
+type testCoreV1Client struct {
+	corev1client.CoreV1Interface
+	h *testHarness
+}
+
+func (c *testCoreV1Client) Pods(namespace string) corev1client.PodInterface {
+	return &testPodClient{PodInterface: c.CoreV1Interface.Pods(namespace), h: c.h}
+}
+
+type testPodClient struct {
+	corev1client.PodInterface
+	h *testHarness
+}
+
+func (c *testPodClient) GetLogs(name string, opts *apiv1.PodLogOptions) *restclient.Request {
+	// record the action like the fake clientset
+	c.PodInterface.GetLogs(name, opts)
+
+	logs := c.h.podLogs(name)
+	client := &fakerest.RESTClient{
+		Client: fakerest.CreateHTTPClient(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(logs))}, nil
+		}),
+		GroupVersion:         apiv1.SchemeGroupVersion,
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+	}
+
+	return client.Request()
+}
+
+// joinMember starts the member with the given index configured with the
+// planned initial cluster, retrying until the member got added to the etcd
+// cluster.
+func (h *testHarness) joinMember(index int) {
+	h.mutex.Lock()
+	_, started := h.members[index]
+	if started || h.joining[index] {
+		h.mutex.Unlock()
+		return
+	}
+	h.joining[index] = true
+	h.mutex.Unlock()
+
+	defer func() {
+		h.mutex.Lock()
+		delete(h.joining, index)
+		h.mutex.Unlock()
+	}()
+
+	var initialCluster []string
+	for i := 1; i <= index; i++ {
+		initialCluster = append(initialCluster, fmt.Sprintf("etcd%d=%s", i, h.peerURL(i)))
+	}
+
+	for {
+		err := h.startMember(index, strings.Join(initialCluster, ","), embed.ClusterStateFlagExisting, h.peerURLs[index])
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+func (h *testHarness) startMember(index int, initialCluster string, state string, advertisePeerURL url.URL) error {
+	cfg := h.memberConfig(index)
+	cfg.AdvertisePeerUrls = []url.URL{advertisePeerURL}
+	cfg.InitialCluster = initialCluster
+	cfg.ClusterState = state
+
+	// a failed start must not leave a data dir behind for the next attempt
+	err := os.RemoveAll(cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	return h.runMember(index, cfg)
+}
+
+// forceNewCluster restarts the member with the given index with
+// --force-new-cluster, keeping its data.
+func (h *testHarness) forceNewCluster(index int) error {
+	h.mutex.Lock()
+	e := h.members[index]
+	delete(h.members, index)
+	h.mutex.Unlock()
+	if e != nil {
+		e.Close()
+	}
+
+	cfg := h.memberConfig(index)
+	cfg.ForceNewCluster = true
+
+	return h.runMember(index, cfg)
+}
+
+func (h *testHarness) memberConfig(index int) *embed.Config {
+	cfg := embed.NewConfig()
+	cfg.Name = fmt.Sprintf("etcd%d", index)
+	cfg.Dir = filepath.Join(h.dir, cfg.Name)
+	cfg.ListenClientUrls = []url.URL{h.clientURLs[index]}
+	cfg.AdvertiseClientUrls = []url.URL{h.clientURLs[index]}
+	cfg.ListenPeerUrls = []url.URL{h.peerURLs[index]}
+	cfg.AdvertisePeerUrls = []url.URL{h.peerURLs[index]}
+	cfg.LogLevel = "error"
+
+	return cfg
+}
+
+// runMember starts the member with the given index and waits until it is
+// ready to serve requests.
+func (h *testHarness) runMember(index int, cfg *embed.Config) error {
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-h.ctx.Done():
+		e.Close()
+		return h.ctx.Err()
+	case <-time.After(testMemberStartTimeout):
+		e.Close()
+		return fmt.Errorf("member %d did not become ready", index)
+	}
+
+	h.mutex.Lock()
+	h.members[index] = e
+	h.mutex.Unlock()
+
+	return nil
+}
+
+// waitForStartedMembers waits until the etcd cluster has the given number of
+// started members.
+func (h *testHarness) waitForStartedMembers(count int) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(testMemberStartTimeout)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(h.ctx, time.Second*2)
+		resp, err := h.etcdClient.MemberList(ctx)
+		cancel()
+		if err == nil {
+			var started int
+			for _, member := range resp.Members {
+				if member.Name != "" {
+					started++
+				}
+			}
+			if started == count && len(resp.Members) == count {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	h.t.Fatalf("etcd cluster did not reach %d started members", count)
+}
+
+func (h *testHarness) memberID(index int) uint64 {
+	h.t.Helper()
+
+	ctx, cancel := context.WithTimeout(h.ctx, time.Second*10)
+	defer cancel()
+
+	resp, err := h.etcdClient.MemberList(ctx)
+	if err != nil {
+		h.t.Fatalf("failed to list members: %#v", err)
+	}
+	for _, member := range resp.Members {
+		if member.Name == fmt.Sprintf("etcd%d", index) {
+			return member.ID
+		}
+	}
+
+	h.t.Fatalf("member %d not found", index)
+	return 0
+}
+
+func (h *testHarness) clientURL(index int) string {
+	u := h.clientURLs[index]
+	return u.String()
+}
+
+func (h *testHarness) peerURL(index int) string {
+	u := h.peerURLs[index]
+	return u.String()
+}
+
+// testJob is a run-command job created in the harness.
+type testJob struct {
+	script string
+	// files contains the data of the Secret holding the files of the job.
+	files map[string][]byte
+}
+
+// createdJobs returns the run-command jobs created so far.
+func (h *testHarness) createdJobs() []testJob {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]testJob(nil), h.jobs...)
+}
+
+// events returns the reasons of all events recorded so far.
+func (h *testHarness) events() []string {
+	var reasons []string
+	for {
+		select {
+		case e := <-h.recorder.Events:
+			reasons = append(reasons, strings.Fields(e)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+// state returns the persisted migration state.
+func (h *testHarness) state() migrationState {
+	h.t.Helper()
+
+	cm, err := h.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Get(context.Background(), stateConfigMap, apismetav1.GetOptions{})
+	if err != nil {
+		h.t.Fatalf("failed to get migration state: %#v", err)
+	}
+	var s migrationState
+	err = json.Unmarshal([]byte(cm.Data[stateKey]), &s)
+	if err != nil {
+		h.t.Fatalf("failed to parse migration state: %#v", err)
+	}
+
+	return s
+}
+
+func testNodeName(index int) string {
+	return fmt.Sprintf("master-%d", index)
+}
+
+// freeURL returns a URL with a free port below the ephemeral port range, so
+// that outgoing connections can not take the port before the member binds it.
+func freeURL(t *testing.T) url.URL {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	for ; nextPort < maxTestPort; nextPort++ {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", nextPort))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		nextPort++
+
+		return url.URL{Scheme: "http", Host: l.Addr().String()}
+	}
+
+	t.Fatalf("failed to find free port")
+	return url.URL{}
+}
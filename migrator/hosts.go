@@ -0,0 +1,136 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	nodeHostsFile = "/etc/hosts"
+
+	hostsBeginMarker = "# etcd-cluster-migrator begin"
+	hostsEndMarker   = "# etcd-cluster-migrator end"
+)
+
+// installHostsEntries writes the etcd peer hosts of all planned members,
+// resolving to the internal IPs of the given nodes running them, into the
+// hosts file of every master node. It is used where the etcd DNS names are
+// not provisioned.
+func (m *Migrator) installHostsEntries(ctx context.Context, nodeNames []string) error {
+	nodes, err := m.listMasterNodes(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	entries, err := hostsEntries(nodes, nodeNames, m.etcdStartingIndex, m.baseDomain)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	for _, n := range nodes {
+		err = m.commandRunner.RunCommands(ctx, n.Name, installHostsCommands(entries))
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("installed etcd peer hosts %s", strings.Join(entries, ", ")), "step", phaseManageHosts, "node", n.Name)
+	}
+	m.recordJobEvent(apiv1.EventTypeNormal, eventReasonHostsInstalled, "installed etcd peer hosts on %d master nodes", len(nodes))
+
+	return nil
+}
+
+// removeHostsEntries removes the etcd peer hosts from the hosts file of every
+// master node.
+func (m *Migrator) removeHostsEntries(ctx context.Context) error {
+	nodes, err := m.listMasterNodes(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	for _, n := range nodes {
+		err = m.commandRunner.RunCommands(ctx, n.Name, removeHostsCommands())
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.logger.LogCtx(ctx, "level", "info", "message", "removed etcd peer hosts", "step", phaseManageHosts, "node", n.Name)
+	}
+	m.recordJobEvent(apiv1.EventTypeNormal, eventReasonHostsRemoved, "removed etcd peer hosts from %d master nodes", len(nodes))
+
+	return nil
+}
+
+// RemoveHostsEntries removes the etcd peer hosts installed for a migration
+// from the hosts file of every master node, e.g. after rolling back to a
+// cluster which does not use them.
+func (m *Migrator) RemoveHostsEntries(ctx context.Context) error {
+	defer m.Close()
+
+	ctx, unlock, err := m.Lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	err = m.removeHostsEntries(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// hostsEntries returns the hosts file entries mapping the peer host of the
+// member on every given node to the internal IP of the node.
+func hostsEntries(nodes []apiv1.Node, nodeNames []string, startingIndex int, baseDomain string) ([]string, error) {
+	ips := map[string]string{}
+	for _, n := range nodes {
+		for _, a := range n.Status.Addresses {
+			if a.Type == apiv1.NodeInternalIP {
+				ips[n.Name] = a.Address
+				break
+			}
+		}
+	}
+
+	var entries []string
+	for i, name := range nodeNames {
+		ip, ok := ips[name]
+		if !ok {
+			return nil, microerror.Maskf(preflightFailedError, "node %s has no internal IP for %s", name, etcdHost(startingIndex+i, baseDomain))
+		}
+		entries = append(entries, fmt.Sprintf("%s %s", ip, etcdHost(startingIndex+i, baseDomain)))
+	}
+
+	return entries, nil
+}
+
+// installHostsCommands returns the commands replacing the marked block of
+// the hosts file with the given entries, so that installing them again does
+// not change the file.
+func installHostsCommands(entries []string) []string {
+	lines := []string{hostsBeginMarker}
+	lines = append(lines, entries...)
+	lines = append(lines, hostsEndMarker)
+
+	var quoted []string
+	for _, l := range lines {
+		quoted = append(quoted, fmt.Sprintf("%q", l))
+	}
+
+	return append(removeHostsCommands(),
+		fmt.Sprintf(`sh -c 'printf "%%s\n" %s >> %s'`, strings.Join(quoted, " "), nodeHostsFile),
+	)
+}
+
+// removeHostsCommands returns the commands removing the marked block from
+// the hosts file.
+func removeHostsCommands() []string {
+	return []string{
+		fmt.Sprintf("touch %s", nodeHostsFile),
+		fmt.Sprintf("sed -i '/^%s$/,/^%s$/d' %s", hostsBeginMarker, hostsEndMarker, nodeHostsFile),
+	}
+}
@@ -0,0 +1,110 @@
+package migrator
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	apiv1 "k8s.io/api/core/v1"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_hostsEntries(t *testing.T) {
+	nodes := []apiv1.Node{
+		testHostsNode("master-1", "10.0.0.1"),
+		testHostsNode("master-2", "10.0.0.2"),
+		testHostsNode("master-3", ""),
+	}
+
+	entries, err := hostsEntries(nodes, []string{"master-2", "master-1"}, 1, "cluster.test")
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	expected := []string{"10.0.0.2 etcd1.cluster.test", "10.0.0.1 etcd2.cluster.test"}
+	if strings.Join(entries, ",") != strings.Join(expected, ",") {
+		t.Fatalf("entries == %v, want %v", entries, expected)
+	}
+
+	_, err = hostsEntries(nodes, []string{"master-1", "master-3"}, 1, "cluster.test")
+	if !IsPreflightFailed(err) {
+		t.Fatalf("expected preflight failed error for node without internal IP got %#v", err)
+	}
+}
+
+func Test_Migrator_installHostsEntries(t *testing.T) {
+	nodes := []apiv1.Node{
+		testHostsNode("master-1", "10.0.0.1"),
+		testHostsNode("master-2", "10.0.0.2"),
+		testHostsNode("master-3", "10.0.0.3"),
+		// a master which does not run a member resolves the peer hosts too
+		testHostsNode("master-4", "10.0.0.4"),
+	}
+
+	k8sClient := fake.NewSimpleClientset()
+	for i := range nodes {
+		_, err := k8sClient.CoreV1().Nodes().Create(context.Background(), &nodes[i], apismetav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("expected nil got %#v", err)
+		}
+	}
+
+	r := &testCommandRunner{}
+	m := &Migrator{
+		baseDomain:        "cluster.test",
+		etcdStartingIndex: 1,
+		masterNodeLabels:  []string{"role=master"},
+
+		commandRunner: r,
+		k8sClient:     k8sClient,
+		logger:        microloggertest.New(),
+	}
+
+	err := m.installHostsEntries(context.Background(), []string{"master-1", "master-2", "master-3"})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if len(r.scripts) != len(nodes) {
+		t.Fatalf("expected hosts to be installed on %d nodes got %v", len(nodes), r.nodeNames)
+	}
+	for _, script := range r.scripts {
+		// the previous block is removed before the new one is appended
+		remove := strings.Index(script, "sed -i")
+		install := strings.Index(script, `"10.0.0.3 etcd3.cluster.test"`)
+		if remove < 0 || install < remove {
+			t.Fatalf("expected block to be replaced in script\n%s", script)
+		}
+		if strings.Contains(script, "etcd4.cluster.test") {
+			t.Fatalf("expected no entry for master without member in script\n%s", script)
+		}
+	}
+
+	r.scripts = nil
+	err = m.removeHostsEntries(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	for _, script := range r.scripts {
+		if script != strings.Join(removeHostsCommands(), "\n") {
+			t.Fatalf("expected block to be removed got script\n%s", script)
+		}
+	}
+}
+
+func testHostsNode(name string, ip string) apiv1.Node {
+	n := apiv1.Node{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"role": "master"},
+		},
+	}
+	if ip != "" {
+		n.Status.Addresses = []apiv1.NodeAddress{
+			{Type: apiv1.NodeHostName, Address: name},
+			{Type: apiv1.NodeInternalIP, Address: ip},
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,322 @@
+package migrator
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// issuedCertDir is the directory on the nodes the issued etcd
+	// certificates are written to.
+	issuedCertDir = "/etc/kubernetes/ssl/etcd/issued"
+	// issuedCertValidity is how long issued certificates are valid.
+	issuedCertValidity = 365 * 24 * time.Hour
+	// issuedCertBackdate is subtracted from the start of the validity to
+	// tolerate clocks of the nodes lagging behind.
+	issuedCertBackdate = 5 * time.Minute
+
+	// etcdCaKeySecretKey is the entry of the CA key Secret holding the PEM
+	// encoded private key.
+	etcdCaKeySecretKey = "tls.key"
+)
+
+// certIssuer issues etcd peer and server certificates signed by the etcd CA.
+type certIssuer struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+}
+
+// memberCertificates are the PEM encoded certificates and keys issued for a
+// member.
+type memberCertificates struct {
+	PeerCert   []byte
+	PeerKey    []byte
+	ServerCert []byte
+	ServerKey  []byte
+}
+
+// newCertIssuer returns a certIssuer for the first certificate in the given
+// PEM encoded CA certificates and the given PEM encoded private key.
+func newCertIssuer(caPEM []byte, caKeyPEM []byte) (*certIssuer, error) {
+	var ca *x509.Certificate
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			return nil, microerror.Maskf(invalidConfigError, "found no PEM encoded CA certificate")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		var err error
+		ca, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		break
+	}
+	if !ca.IsCA {
+		return nil, microerror.Maskf(invalidConfigError, "certificate of %s is not a CA", ca.Subject)
+	}
+
+	caKey, err := parsePrivateKey(caKeyPEM)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	public, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(ca.PublicKey) {
+		return nil, microerror.Maskf(invalidConfigError, "private key does not belong to the CA certificate of %s", ca.Subject)
+	}
+
+	i := &certIssuer{
+		ca:    ca,
+		caKey: caKey,
+	}
+
+	return i, nil
+}
+
+// certIssuerFromFiles returns a certIssuer for the CA certificate and key in
+// the given files.
+func certIssuerFromFiles(caFile string, caKeyFile string) (*certIssuer, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	caKeyPEM, err := os.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	issuer, err := newCertIssuer(caPEM, caKeyPEM)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return issuer, nil
+}
+
+// parsePrivateKey parses the first PEM encoded PKCS #1, PKCS #8 or EC
+// private key in the given data.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, keyPEM = pem.Decode(keyPEM)
+		if block == nil {
+			return nil, microerror.Maskf(invalidConfigError, "found no PEM encoded private key")
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			return key, nil
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			return key, nil
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, microerror.Maskf(invalidConfigError, "private key of type %T can not sign certificates", key)
+			}
+			return signer, nil
+		}
+	}
+}
+
+// issueMemberCertificates issues the peer and server certificates of the
+// member with the given host running on a node with the given IPs. Both
+// are used for client authentication as well, as etcd presents them when
+// connecting to other members.
+func (i *certIssuer) issueMemberCertificates(host string, ips []net.IP, now time.Time) (*memberCertificates, error) {
+	var err error
+	var certs memberCertificates
+
+	certs.PeerCert, certs.PeerKey, err = i.issue(host, []string{host}, ips, now)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	serverIPs := append([]net.IP{net.IPv4(127, 0, 0, 1)}, ips...)
+	certs.ServerCert, certs.ServerKey, err = i.issue(host, []string{host, "localhost"}, serverIPs, now)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return &certs, nil
+}
+
+// issue returns a new PEM encoded certificate and private key with the given
+// SANs, signed by the CA.
+func (i *certIssuer) issue(commonName string, dnsNames []string, ips []net.IP, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-issuedCertBackdate),
+		NotAfter:     now.Add(issuedCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, &key.PublicKey, i.caKey)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// loadCertIssuer returns the certIssuer of the migrator, loading the CA key
+// from the configured Secret on first use. It returns nil when no CA key is
+// configured.
+func (m *Migrator) loadCertIssuer(ctx context.Context) (*certIssuer, error) {
+	if m.certIssuer != nil || m.etcdCaKeySecret == "" {
+		return m.certIssuer, nil
+	}
+
+	namespace, name, err := splitSecretName(m.etcdCaKeySecret)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	secret, err := m.k8sClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	caKeyPEM, ok := secret.Data[etcdCaKeySecretKey]
+	if !ok {
+		return nil, microerror.Maskf(invalidConfigError, "secret %s has no %s entry", m.etcdCaKeySecret, etcdCaKeySecretKey)
+	}
+	caPEM, err := os.ReadFile(m.etcdCaFile)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	m.certIssuer, err = newCertIssuer(caPEM, caKeyPEM)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return m.certIssuer, nil
+}
+
+// issueNodeCertificates issues the certificates of the member with the given
+// index running on the given node. Besides the host of the member's peer
+// URL they cover the internal IPs of the node.
+func (m *Migrator) issueNodeCertificates(ctx context.Context, issuer *certIssuer, nodeName string, index int) (*memberCertificates, error) {
+	node, err := m.k8sClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var ips []net.IP
+	for _, a := range node.Status.Addresses {
+		if a.Type != apiv1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(a.Address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	host := etcdHost(index, m.baseDomain)
+	certs, err := issuer.issueMemberCertificates(host, ips, m.clock.Now())
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("issued etcd peer and server certificates for %s", host), "step", phaseIssueCerts, "node", nodeName)
+
+	return certs, nil
+}
+
+// installCertificatesFiles returns the given certificates keyed by their path
+// in issuedCertDir on the node, and the commands pointing the etcd3 service
+// to them. The files must be written by a NodeCommandFileRunner, so that
+// the private keys are never part of the commands.
+func installCertificatesFiles(certs *memberCertificates) (map[string][]byte, []string) {
+	files := []struct {
+		flag    string
+		name    string
+		content []byte
+	}{
+		{flag: "--peer-cert-file", name: "peer-crt.pem", content: certs.PeerCert},
+		{flag: "--peer-key-file", name: "peer-key.pem", content: certs.PeerKey},
+		{flag: "--cert-file", name: "server-crt.pem", content: certs.ServerCert},
+		{flag: "--key-file", name: "server-key.pem", content: certs.ServerKey},
+	}
+
+	contents := map[string][]byte{}
+	var commands []string
+	for _, f := range files {
+		p := path.Join(issuedCertDir, f.name)
+		contents[p] = f.content
+		commands = append(commands, setFlagCommands(f.flag, p)...)
+	}
+
+	return contents, commands
+}
+
+// setFlagCommands returns the commands setting the value of the given flag
+// of the etcd3 service, given either as --flag=value or --flag value. They
+// fail when the service file does not set the flag, as sed would silently
+// leave it unchanged.
+func setFlagCommands(flag string, value string) []string {
+	return []string{
+		fmt.Sprintf("grep -qE -- '%s[= ]' %s", flag, etcdServiceFile),
+		fmt.Sprintf("sed -i -E 's#%s[= ][^ \\\\]*#%s=%s#g' %s", flag, flag, value, etcdServiceFile),
+	}
+}
+
+// splitSecretName splits the given namespace/name of a Secret.
+func splitSecretName(s string) (string, string, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", microerror.Maskf(invalidConfigError, "secret %q must be given as namespace/name", s)
+	}
+
+	return parts[0], parts[1], nil
+}
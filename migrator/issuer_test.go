@@ -0,0 +1,233 @@
+package migrator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_newCertIssuer(t *testing.T) {
+	now := time.Now()
+
+	caPEM, caKeyPEM := testCA(t, now)
+	_, otherKeyPEM := testCA(t, now)
+	leaf, leafKey := testCertificate(t, nil, nil, &x509.Certificate{
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+	})
+
+	testCases := []struct {
+		name         string
+		caPEM        []byte
+		caKeyPEM     []byte
+		errorMatcher func(error) bool
+	}{
+		{
+			name:     "case 0: CA certificate and key",
+			caPEM:    caPEM,
+			caKeyPEM: caKeyPEM,
+		},
+		{
+			name:         "case 1: key of another CA",
+			caPEM:        caPEM,
+			caKeyPEM:     otherKeyPEM,
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name:         "case 2: certificate is no CA",
+			caPEM:        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}),
+			caKeyPEM:     testKeyPEM(t, leafKey),
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name:         "case 3: no key",
+			caPEM:        caPEM,
+			errorMatcher: IsInvalidConfig,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := newCertIssuer(tc.caPEM, tc.caKeyPEM)
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_certIssuer_issueMemberCertificates(t *testing.T) {
+	now := time.Now()
+
+	caPEM, caKeyPEM := testCA(t, now)
+	issuer, err := newCertIssuer(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	certs, err := issuer.issueMemberCertificates("etcd2.cluster.test", []net.IP{net.ParseIP("10.0.0.2")}, now)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	for _, host := range []string{"etcd2.cluster.test", "10.0.0.2"} {
+		err = verifyCertificate(certs.PeerCert, roots, host, now)
+		if err != nil {
+			t.Fatalf("expected peer certificate to cover %s got %#v", host, err)
+		}
+	}
+	for _, host := range []string{"etcd2.cluster.test", "10.0.0.2", "localhost", "127.0.0.1"} {
+		err = verifyCertificate(certs.ServerCert, roots, host, now)
+		if err != nil {
+			t.Fatalf("expected server certificate to cover %s got %#v", host, err)
+		}
+	}
+	err = verifyCertificate(certs.PeerCert, roots, "etcd3.cluster.test", now)
+	if !IsPreflightFailed(err) {
+		t.Fatalf("expected peer certificate not to cover etcd3.cluster.test got %#v", err)
+	}
+
+	_, err = parsePrivateKey(certs.PeerKey)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+}
+
+func Test_Migrator_Run_IssueCertificates(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	caPEM, caKeyPEM := testCA(t, time.Now())
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, caPEM, 0600)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	secret := &apiv1.Secret{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:      "etcd-ca",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			etcdCaKeySecretKey: caKeyPEM,
+		},
+	}
+	_, err = h.k8sClient.CoreV1().Secrets(secret.Namespace).Create(context.Background(), secret, apismetav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	c := h.migratorConfig()
+	c.EtcdCaFile = caFile
+	c.EtcdCaKeySecret = "kube-system/etcd-ca"
+
+	// the private keys must not be passed as commands
+	{
+		c := c
+		c.NodeCommandRunner = &testCommandRunner{h: h}
+		_, err = NewMigrator(c)
+		if !IsInvalidConfig(err) {
+			t.Fatalf("expected invalid config error got %#v", err)
+		}
+	}
+
+	err = h.newMigratorWithConfig(c).Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	var configured int
+	for _, job := range h.createdJobs() {
+		if !strings.Contains(job.script, "systemctl start etcd3") {
+			continue
+		}
+		configured++
+
+		if strings.Contains(job.script, "PRIVATE KEY") || strings.Contains(job.script, "base64") {
+			t.Fatalf("expected no key material in script\n%s", job.script)
+		}
+		var keys int
+		for _, content := range job.files {
+			if strings.Contains(string(content), "PRIVATE KEY") {
+				keys++
+			}
+		}
+		if len(job.files) != 4 || keys != 2 {
+			t.Fatalf("expected certificates and 2 keys in the job secret got %d files with %d keys", len(job.files), keys)
+		}
+
+		files := map[string]string{
+			"--peer-cert-file": "peer-crt.pem",
+			"--peer-key-file":  "peer-key.pem",
+			"--cert-file":      "server-crt.pem",
+			"--key-file":       "server-key.pem",
+		}
+		for flag, name := range files {
+			p := filepath.Join(issuedCertDir, name)
+			if !strings.Contains(job.script, "/proc/1/root"+p) {
+				t.Fatalf("expected %s to be copied in script\n%s", p, job.script)
+			}
+			for _, command := range setFlagCommands(flag, p) {
+				if !strings.Contains(job.script, command) {
+					t.Fatalf("expected %s to be installed as %s in script\n%s", p, flag, job.script)
+				}
+			}
+		}
+	}
+	if configured != testMemberCount-1 {
+		t.Fatalf("expected %d configured nodes got %d", testMemberCount-1, configured)
+	}
+
+	// the secret only exists while the job runs
+	_, err = h.k8sClient.CoreV1().Secrets(runCommandNamespace).Get(context.Background(), runCommandSecret, apismetav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		t.Fatalf("expected job secret to be deleted got %#v", err)
+	}
+}
+
+// testCA returns a PEM encoded self signed CA certificate and its key.
+func testCA(t *testing.T, now time.Time) ([]byte, []byte) {
+	ca, key := testCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "etcd-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), testKeyPEM(t, key)
+}
+
+func testKeyPEM(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
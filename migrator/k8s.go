@@ -1,10 +1,15 @@
 package migrator
 
 import (
+	"context"
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/giantswarm/microerror"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -13,6 +18,14 @@ const (
 	labelMasterID = "giantswarm.io/master-id"
 )
 
+// defaultMasterNodeLabels match the master nodes of the control-plane, the
+// legacy master and the Giant Swarm role label schemes.
+var defaultMasterNodeLabels = []string{
+	"node-role.kubernetes.io/control-plane",
+	"node-role.kubernetes.io/master",
+	"role=master",
+}
+
 func createK8SClient() (kubernetes.Interface, error) {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
@@ -28,17 +41,247 @@ func createK8SClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
-// getNodeNames return nodeName list ordered by master id label.
-func getNodeNames(nodes []v1.Node) []string {
-	// sort nodes by masterID
-	sort.Slice(nodes, func(i int, j int) bool {
-		return nodes[i].Labels[labelMasterID] < nodes[j].Labels[labelMasterID]
+// listMasterNodes returns the nodes matching any of the master node label
+// selectors. Nodes matching more than one selector are returned once, so
+// clusters in the middle of moving from one label scheme to another are
+// handled as well.
+func (m *Migrator) listMasterNodes(ctx context.Context) ([]v1.Node, error) {
+	var nodes []v1.Node
+	var matched []string
+	found := map[string]bool{}
+	for _, selector := range m.masterNodeLabels {
+		nodeList, err := m.k8sClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		if len(nodeList.Items) > 0 {
+			matched = append(matched, selector)
+		}
+
+		for _, n := range nodeList.Items {
+			if found[n.Name] {
+				continue
+			}
+			found[n.Name] = true
+			nodes = append(nodes, n)
+		}
+	}
+	m.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("found %d master nodes matching %s", len(nodes), strings.Join(matched, ", ")), "step", phaseDiscover)
+
+	return nodes, nil
+}
+
+// skippedNode is a master node which does not run an etcd member.
+type skippedNode struct {
+	name   string
+	reason string
+}
+
+// nodeSelection configures how the master nodes running the etcd members are
+// selected.
+type nodeSelection struct {
+	masterIDLabel string
+	memberCount   int
+	// memberNodes maps the position of a member to the node it runs on.
+	memberNodes map[int]string
+	nodeOrder   []string
+}
+
+// configuredNode returns the node configured explicitly for the member at
+// the given position, either through the member nodes or the node order.
+func (s nodeSelection) configuredNode(position int) (string, bool) {
+	if name, ok := s.memberNodes[position]; ok {
+		return name, true
+	}
+	if position < len(s.nodeOrder) {
+		return s.nodeOrder[position], true
+	}
+
+	return "", false
+}
+
+// selectMasterNodes returns the names of the nodes running the etcd members,
+// ordered by their position, and the master nodes which were skipped.
+//
+// The given member nodes map the positions of the members which were already
+// added to their nodes. These nodes keep their positions whatever their
+// condition, so that a member is never mapped to another node. Of the other
+// nodes, those which are not ready, cordoned or being deleted are skipped.
+// The nodes mapped to a position explicitly are used for it, the remaining
+// positions are filled in the master ID or explicit node order. Nil is
+// returned when there are not enough eligible master nodes.
+func selectMasterNodes(nodes []v1.Node, s nodeSelection, memberNodes map[int]string) ([]string, []skippedNode, error) {
+	selected := make([]string, s.memberCount)
+	used := map[string]bool{}
+	masters := map[string]bool{}
+	for _, n := range nodes {
+		masters[n.Name] = true
+	}
+	for position, name := range memberNodes {
+		if position >= s.memberCount {
+			continue
+		}
+		if !masters[name] {
+			return nil, nil, microerror.Maskf(preflightFailedError, "node %s of the etcd member at position %d is not a master node", name, position)
+		}
+		if configured, ok := s.memberNodes[position]; ok && configured != name {
+			return nil, nil, microerror.Maskf(invalidConfigError, "member node %s is configured for position %d, but its etcd member runs on node %s", configured, position, name)
+		}
+		selected[position] = name
+		used[name] = true
+	}
+
+	var eligible []v1.Node
+	var skipped []skippedNode
+	reasons := map[string]string{}
+	for _, n := range nodes {
+		if used[n.Name] {
+			continue
+		}
+		reason := ineligibleReason(n)
+		reasons[n.Name] = reason
+		if reason != "" {
+			skipped = append(skipped, skippedNode{name: n.Name, reason: reason})
+			continue
+		}
+		eligible = append(eligible, n)
+	}
+
+	for position, name := range s.memberNodes {
+		if selected[position] != "" {
+			continue
+		}
+		reason, ok := reasons[name]
+		if used[name] {
+			return nil, nil, microerror.Maskf(invalidConfigError, "member node %s is configured for position %d, but already runs another etcd member", name, position)
+		} else if !ok {
+			return nil, nil, microerror.Maskf(invalidConfigError, "member node %s is not a master node", name)
+		} else if reason != "" {
+			return nil, nil, microerror.Maskf(preflightFailedError, "member node %s is %s", name, reason)
+		}
+		selected[position] = name
+		used[name] = true
+	}
+
+	for _, name := range s.nodeOrder {
+		if !masters[name] {
+			return nil, nil, microerror.Maskf(invalidConfigError, "node order contains %s which is not a master node", name)
+		}
+	}
+
+	// only the nodes filling the remaining positions need to be ordered
+	var candidates []v1.Node
+	for _, n := range eligible {
+		if !used[n.Name] {
+			candidates = append(candidates, n)
+		}
+	}
+	ordered, err := getNodeNames(candidates, s.masterIDLabel, s.nodeOrder)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+	if len(s.nodeOrder) > 0 {
+		inOrder := map[string]bool{}
+		for _, name := range ordered {
+			inOrder[name] = true
+		}
+		for _, n := range candidates {
+			if !inOrder[n.Name] {
+				skipped = append(skipped, skippedNode{name: n.Name, reason: "not in the node order"})
+			}
+		}
+	}
+
+	next := 0
+	for position := range selected {
+		if selected[position] != "" {
+			continue
+		}
+		if next == len(ordered) {
+			return nil, skipped, nil
+		}
+		selected[position] = ordered[next]
+		next++
+	}
+	for _, name := range ordered[next:] {
+		skipped = append(skipped, skippedNode{name: name, reason: "not needed for the etcd members"})
+	}
+
+	return selected, skipped, nil
+}
+
+// ineligibleReason returns why the given node can not run an etcd member, or
+// an empty string if it can.
+func ineligibleReason(n v1.Node) string {
+	if n.DeletionTimestamp != nil {
+		return "being deleted"
+	}
+	if n.Spec.Unschedulable {
+		return "cordoned"
+	}
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady && c.Status == v1.ConditionTrue {
+			return ""
+		}
+	}
+	return "not ready"
+}
+
+// getNodeNames returns the names of the given nodes ordered by the numeric
+// master ID in the given label. When an explicit node order is given, it is
+// used instead of the label and nodes missing in it are left out.
+func getNodeNames(nodes []v1.Node, masterIDLabel string, nodeOrder []string) ([]string, error) {
+	if len(nodeOrder) > 0 {
+		return orderNodeNames(nodes, nodeOrder)
+	}
+
+	ids := map[string]int{}
+	owners := map[int]string{}
+	for _, n := range nodes {
+		value, ok := n.Labels[masterIDLabel]
+		if !ok {
+			return nil, microerror.Maskf(preflightFailedError, "node %s has no %s label", n.Name, masterIDLabel)
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, microerror.Maskf(preflightFailedError, "node %s has non-numeric %s label %q", n.Name, masterIDLabel, value)
+		}
+		if owner, ok := owners[id]; ok {
+			return nil, microerror.Maskf(preflightFailedError, "nodes %s and %s have the same %s label %q", owner, n.Name, masterIDLabel, value)
+		}
+		ids[n.Name] = id
+		owners[id] = n.Name
+	}
+
+	var list []string
+	for _, n := range nodes {
+		list = append(list, n.Name)
+	}
+	sort.Slice(list, func(i int, j int) bool {
+		return ids[list[i]] < ids[list[j]]
 	})
 
-	list := []string{
-		nodes[0].Name,
-		nodes[1].Name,
-		nodes[2].Name,
+	return list, nil
+}
+
+func orderNodeNames(nodes []v1.Node, nodeOrder []string) ([]string, error) {
+	found := map[string]bool{}
+	for _, n := range nodes {
+		found[n.Name] = true
+	}
+
+	var list []string
+	seen := map[string]bool{}
+	for _, name := range nodeOrder {
+		if seen[name] {
+			return nil, microerror.Maskf(invalidConfigError, "node order contains %s more than once", name)
+		}
+		seen[name] = true
+
+		if found[name] {
+			list = append(list, name)
+		}
 	}
-	return list
+
+	return list, nil
 }
@@ -1,18 +1,24 @@
 package migrator
 
 import (
+	"context"
+	"sort"
 	"strconv"
 	"testing"
 
+	"github.com/giantswarm/micrologger/microloggertest"
 	v1 "k8s.io/api/core/v1"
 	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func Test_getNodeNames(t *testing.T) {
 	testCases := []struct {
 		name            string
 		nodes           []v1.Node
+		nodeOrder       []string
 		sortedNodeNames []string
+		errorMatcher    func(error) bool
 	}{
 		{
 			name: "case 0: ordered nodes",
@@ -104,12 +110,91 @@ func Test_getNodeNames(t *testing.T) {
 			},
 			sortedNodeNames: []string{"node-1", "node-2", "node-3"},
 		},
+		{
+			name: "case 3: numeric order of master ids",
+			nodes: []v1.Node{
+				testNode("node-10", "10"),
+				testNode("node-2", "2"),
+				testNode("node-1", "1"),
+			},
+			sortedNodeNames: []string{"node-1", "node-2", "node-10"},
+		},
+		{
+			name: "case 4: missing master id",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				{
+					ObjectMeta: apismetav1.ObjectMeta{
+						Name: "node-2",
+					},
+				},
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 5: duplicate master id",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "1"),
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 6: non-numeric master id",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "two"),
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 7: explicit node order without labels",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+				testNode("node-c", ""),
+			},
+			nodeOrder:       []string{"node-c", "node-a", "node-b"},
+			sortedNodeNames: []string{"node-c", "node-a", "node-b"},
+		},
+		{
+			name: "case 8: explicit node order leaves out other nodes",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+			},
+			nodeOrder:       []string{"node-b", "node-x", "node-a"},
+			sortedNodeNames: []string{"node-b", "node-a"},
+		},
+		{
+			name: "case 9: explicit node order with duplicate node",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+			},
+			nodeOrder:    []string{"node-a", "node-a"},
+			errorMatcher: IsInvalidConfig,
+		},
 	}
 
 	for i, tc := range testCases {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			nodeNames := getNodeNames(tc.nodes)
+			nodeNames, err := getNodeNames(tc.nodes, labelMasterID, tc.nodeOrder)
 
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+
+			if len(nodeNames) != len(tc.sortedNodeNames) {
+				t.Fatalf("%s: expected %v got %v", tc.name, tc.sortedNodeNames, nodeNames)
+			}
 			for i := 0; i < len(nodeNames); i++ {
 				if nodeNames[i] != tc.sortedNodeNames[i] {
 					t.Fatalf("sorted nodes are not equal")
@@ -119,3 +204,315 @@ func Test_getNodeNames(t *testing.T) {
 		})
 	}
 }
+
+func Test_selectMasterNodes(t *testing.T) {
+	testCases := []struct {
+		name          string
+		nodes         []v1.Node
+		selection     nodeSelection
+		memberNodes   map[int]string
+		selectedNodes []string
+		skippedNodes  []string
+		errorMatcher  func(error) bool
+	}{
+		{
+			name: "case 0: exact number of masters",
+			nodes: []v1.Node{
+				testNode("node-2", "2"),
+				testNode("node-1", "1"),
+				testNode("node-3", "3"),
+			},
+			selection:     nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			selectedNodes: []string{"node-1", "node-2", "node-3"},
+		},
+		{
+			name: "case 1: replacement master with the same master id",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				deletedNode(testNode("node-2", "2")),
+				testNode("node-2-new", "2"),
+				testNode("node-3", "3"),
+			},
+			selection:     nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			selectedNodes: []string{"node-1", "node-2-new", "node-3"},
+			skippedNodes:  []string{"node-2"},
+		},
+		{
+			name: "case 2: not ready and cordoned masters are skipped",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				notReadyNode(testNode("node-2", "2")),
+				cordonedNode(testNode("node-3", "3")),
+				testNode("node-4", "4"),
+				testNode("node-5", "5"),
+			},
+			selection:     nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			selectedNodes: []string{"node-1", "node-4", "node-5"},
+			skippedNodes:  []string{"node-2", "node-3"},
+		},
+		{
+			name: "case 3: more eligible masters than members",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "2"),
+				testNode("node-3", "3"),
+				testNode("node-4", "4"),
+			},
+			selection:     nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			selectedNodes: []string{"node-1", "node-2", "node-3"},
+			skippedNodes:  []string{"node-4"},
+		},
+		{
+			name: "case 4: not enough eligible masters",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				notReadyNode(testNode("node-2", "2")),
+				testNode("node-3", "3"),
+			},
+			selection:    nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			skippedNodes: []string{"node-2"},
+		},
+		{
+			name: "case 5: member nodes without master id labels",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+				testNode("node-c", ""),
+			},
+			selection: nodeSelection{
+				masterIDLabel: labelMasterID,
+				memberCount:   3,
+				memberNodes:   map[int]string{0: "node-b", 1: "node-c", 2: "node-a"},
+			},
+			selectedNodes: []string{"node-b", "node-c", "node-a"},
+		},
+		{
+			name: "case 6: member node fills its position before ordered nodes",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "2"),
+				testNode("node-3", "3"),
+				testNode("node-4", "4"),
+			},
+			selection: nodeSelection{
+				masterIDLabel: labelMasterID,
+				memberCount:   3,
+				memberNodes:   map[int]string{1: "node-4"},
+			},
+			selectedNodes: []string{"node-1", "node-4", "node-2"},
+			skippedNodes:  []string{"node-3"},
+		},
+		{
+			name: "case 7: member node is not ready",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				notReadyNode(testNode("node-2", "2")),
+			},
+			selection: nodeSelection{
+				masterIDLabel: labelMasterID,
+				memberCount:   2,
+				memberNodes:   map[int]string{1: "node-2"},
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 8: member node is not a master",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "2"),
+			},
+			selection: nodeSelection{
+				masterIDLabel: labelMasterID,
+				memberCount:   2,
+				memberNodes:   map[int]string{1: "node-x"},
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name: "case 9: node order with unknown node",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+			},
+			selection: nodeSelection{
+				memberCount: 2,
+				nodeOrder:   []string{"node-a", "node-x"},
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name: "case 10: node order skips nodes not in it",
+			nodes: []v1.Node{
+				testNode("node-a", ""),
+				testNode("node-b", ""),
+				testNode("node-c", ""),
+			},
+			selection: nodeSelection{
+				memberCount: 2,
+				nodeOrder:   []string{"node-c", "node-a"},
+			},
+			selectedNodes: []string{"node-c", "node-a"},
+			skippedNodes:  []string{"node-b"},
+		},
+		{
+			name: "case 11: nodes running members keep their positions",
+			nodes: []v1.Node{
+				notReadyNode(testNode("node-1", "1")),
+				cordonedNode(testNode("node-2", "2")),
+				notReadyNode(testNode("node-3", "3")),
+				testNode("node-4", "4"),
+			},
+			selection:     nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			memberNodes:   map[int]string{0: "node-1", 1: "node-2"},
+			selectedNodes: []string{"node-1", "node-2", "node-4"},
+			skippedNodes:  []string{"node-3"},
+		},
+		{
+			name: "case 12: node running a member is gone",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-3", "3"),
+				testNode("node-4", "4"),
+			},
+			selection:    nodeSelection{masterIDLabel: labelMasterID, memberCount: 3},
+			memberNodes:  map[int]string{0: "node-1", 1: "node-2"},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 13: member node configured for the position of another node",
+			nodes: []v1.Node{
+				testNode("node-1", "1"),
+				testNode("node-2", "2"),
+				testNode("node-3", "3"),
+			},
+			selection: nodeSelection{
+				masterIDLabel: labelMasterID,
+				memberCount:   3,
+				memberNodes:   map[int]string{1: "node-3"},
+			},
+			memberNodes:  map[int]string{0: "node-1", 1: "node-2"},
+			errorMatcher: IsInvalidConfig,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			selected, skipped, err := selectMasterNodes(tc.nodes, tc.selection, tc.memberNodes)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+
+			if len(selected) != len(tc.selectedNodes) {
+				t.Fatalf("%s: expected selected nodes %v got %v", tc.name, tc.selectedNodes, selected)
+			}
+			for i := range selected {
+				if selected[i] != tc.selectedNodes[i] {
+					t.Fatalf("%s: expected selected nodes %v got %v", tc.name, tc.selectedNodes, selected)
+				}
+			}
+
+			var skippedNames []string
+			for _, n := range skipped {
+				skippedNames = append(skippedNames, n.name)
+			}
+			if len(skippedNames) != len(tc.skippedNodes) {
+				t.Fatalf("%s: expected skipped nodes %v got %v", tc.name, tc.skippedNodes, skippedNames)
+			}
+			for i := range skippedNames {
+				if skippedNames[i] != tc.skippedNodes[i] {
+					t.Fatalf("%s: expected skipped nodes %v got %v", tc.name, tc.skippedNodes, skippedNames)
+				}
+			}
+		})
+	}
+}
+
+func Test_Migrator_listMasterNodes(t *testing.T) {
+	k8sClient := fake.NewSimpleClientset(
+		labelledNode("node-1", map[string]string{"node-role.kubernetes.io/master": ""}),
+		labelledNode("node-2", map[string]string{"node-role.kubernetes.io/master": "", "node-role.kubernetes.io/control-plane": ""}),
+		labelledNode("node-3", map[string]string{"node-role.kubernetes.io/control-plane": ""}),
+		labelledNode("worker-1", map[string]string{"node-role.kubernetes.io/worker": ""}),
+	)
+
+	m := &Migrator{
+		k8sClient:        k8sClient,
+		logger:           microloggertest.New(),
+		masterNodeLabels: defaultMasterNodeLabels,
+	}
+
+	nodes, err := m.listMasterNodes(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"node-1", "node-2", "node-3"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected master nodes %v got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("expected master nodes %v got %v", expected, names)
+		}
+	}
+}
+
+func testNode(name string, masterID string) v1.Node {
+	n := v1.Node{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{
+					Type:   v1.NodeReady,
+					Status: v1.ConditionTrue,
+				},
+			},
+		},
+	}
+	if masterID != "" {
+		n.Labels[labelMasterID] = masterID
+	}
+
+	return n
+}
+
+func cordonedNode(n v1.Node) v1.Node {
+	n.Spec.Unschedulable = true
+	return n
+}
+
+func deletedNode(n v1.Node) v1.Node {
+	now := apismetav1.Now()
+	n.DeletionTimestamp = &now
+	return n
+}
+
+func notReadyNode(n v1.Node) v1.Node {
+	n.Status.Conditions = nil
+	return n
+}
+
+func labelledNode(name string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
@@ -0,0 +1,227 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/giantswarm/etcd-cluster-migrator/pkg/project"
+)
+
+const (
+	lockLease = "etcd-cluster-migrator-lock"
+
+	lockReleaseTimeout = time.Second * 10
+)
+
+// lockIdentity returns the holder identity of the migration lock. The host
+// name is the pod name, which tells operators which migrator holds the lock,
+// and the UUID keeps migrators in the same pod apart.
+func lockIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = project.Name()
+	}
+
+	return fmt.Sprintf("%s_%s", hostname, uuid.NewUUID())
+}
+
+// Lock acquires the cluster-wide migration lock, a Lease in the namespace of
+// the run-command Jobs, so that only one migrator changes the etcd cluster at
+// a time. Migrators only exclude each other when they use the same namespace.
+// A lock held by another migrator fails with lockHeldError naming the holder.
+//
+// The lock is renewed in the background until the returned release function
+// is called. The returned context is cancelled when the lock is lost, in
+// which case its cause is a lockHeldError.
+func (m *Migrator) Lock(ctx context.Context) (context.Context, func(), error) {
+	lease, err := m.acquireLease(ctx)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("acquired migration lock %s/%s", m.namespace, lockLease), "holder", m.lockIdentity)
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.renewLease(lockCtx, cancel, lease)
+	}()
+
+	release := func() {
+		cancel(nil)
+		<-done
+		m.releaseLease(ctx)
+	}
+
+	return lockCtx, release, nil
+}
+
+func (m *Migrator) acquireLease(ctx context.Context) (*coordinationv1.Lease, error) {
+	leases := m.k8sClient.CoordinationV1().Leases(m.namespace)
+
+	lease, err := leases.Get(ctx, lockLease, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      lockLease,
+				Namespace: m.namespace,
+				Labels: map[string]string{
+					"app":        lockLease,
+					"created-by": project.Name(),
+				},
+			},
+		}
+		m.setLeaseHolder(lease)
+
+		lease, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return nil, microerror.Maskf(lockHeldError, "migration lock %s/%s was acquired by another migrator concurrently", m.namespace, lockLease)
+		} else if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		return lease, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	if m.isHeldByOther(lease) {
+		return nil, microerror.Maskf(lockHeldError, "migration lock %s/%s is held by %s, last renewed at %s", m.namespace, lockLease, *lease.Spec.HolderIdentity, lease.Spec.RenewTime.UTC().Format(time.RFC3339))
+	}
+
+	// the lease is free, expired or our own, so take it over
+	m.setLeaseHolder(lease)
+	lease, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return nil, microerror.Maskf(lockHeldError, "migration lock %s/%s was acquired by another migrator concurrently", m.namespace, lockLease)
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return lease, nil
+}
+
+// renewLease renews the given lease until the context is cancelled. The
+// context is cancelled with a lockHeldError once the API shows that another
+// migrator took the lease over.
+//
+// Failing renewals never give the lock up on their own. The Kubernetes API
+// is expected to be down while a new member syncs, which may take longer
+// than the lease duration, so renewing is retried until the API answers
+// again. Another migrator can only take the lease over once it sees it
+// expired, which the next renewal then notices.
+func (m *Migrator) renewLease(ctx context.Context, cancel context.CancelCauseFunc, lease *coordinationv1.Lease) {
+	leases := m.k8sClient.CoordinationV1().Leases(m.namespace)
+	renewed := m.clock.Now()
+
+	for {
+		err := sleep(ctx, m.clock, m.intervals.lockRenew)
+		if err != nil {
+			return
+		}
+
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: m.clock.Now()}
+		updated, err := leases.Update(ctx, lease, metav1.UpdateOptions{})
+		if err == nil {
+			lease = updated
+			renewed = m.clock.Now()
+			continue
+		}
+		m.logger.Errorf(ctx, err, "failed to renew migration lock %s/%s, last renewed at %s", m.namespace, lockLease, renewed.UTC().Format(time.RFC3339))
+
+		current, err := leases.Get(ctx, lockLease, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			// the lease got deleted, so take it again unless another
+			// migrator was faster
+			current, err = m.acquireLease(ctx)
+			if IsLockHeld(err) {
+				cancel(err)
+				return
+			}
+		}
+		if err != nil {
+			// the API is down, keep the lock and retry
+			continue
+		}
+
+		if current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != m.lockIdentity {
+			holder := "nobody"
+			if current.Spec.HolderIdentity != nil && *current.Spec.HolderIdentity != "" {
+				holder = *current.Spec.HolderIdentity
+			}
+			cancel(microerror.Maskf(lockHeldError, "migration lock %s/%s was taken over by %s", m.namespace, lockLease, holder))
+			return
+		}
+		lease = current
+	}
+}
+
+// releaseLease deletes the lease if it is still held by this migrator. It
+// uses its own context so that the lock is released when the migrator is
+// being cancelled.
+func (m *Migrator) releaseLease(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+
+	leases := m.k8sClient.CoordinationV1().Leases(m.namespace)
+
+	lease, err := leases.Get(ctx, lockLease, metav1.GetOptions{})
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to release migration lock %s/%s", m.namespace, lockLease)
+		return
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != m.lockIdentity {
+		return
+	}
+
+	err = leases.Delete(ctx, lockLease, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			ResourceVersion: &lease.ResourceVersion,
+		},
+	})
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to release migration lock %s/%s", m.namespace, lockLease)
+		return
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("released migration lock %s/%s", m.namespace, lockLease), "holder", m.lockIdentity)
+}
+
+// isHeldByOther returns true if the given lease is held by another migrator
+// and has not expired yet.
+func (m *Migrator) isHeldByOther(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" || *lease.Spec.HolderIdentity == m.lockIdentity {
+		return false
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return m.clock.Now().Before(expiry)
+}
+
+func (m *Migrator) setLeaseHolder(lease *coordinationv1.Lease) {
+	now := metav1.MicroTime{Time: m.clock.Now()}
+	duration := int32(m.intervals.lockLease.Seconds())
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != m.lockIdentity {
+		var transitions int32
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.HolderIdentity = &m.lockIdentity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+}
@@ -0,0 +1,243 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_Migrator_Lock(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		lease         *coordinationv1.Lease
+		errorMatcher  func(error) bool
+		expectedOwner bool
+	}{
+		{
+			name:          "case 0: acquire free lock",
+			expectedOwner: true,
+		},
+		{
+			name:         "case 1: lock held by another migrator",
+			lease:        testLease("other", now.Add(-time.Second*10)),
+			errorMatcher: IsLockHeld,
+		},
+		{
+			name:          "case 2: take over expired lock",
+			lease:         testLease("other", now.Add(-defaultIntervals().lockLease*2)),
+			expectedOwner: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			k8sClient := fake.NewSimpleClientset()
+			if tc.lease != nil {
+				_, err := k8sClient.CoordinationV1().Leases(runCommandNamespace).Create(context.Background(), tc.lease, metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("%s: expected nil got %#v", tc.name, err)
+				}
+			}
+
+			m := &Migrator{
+				clock:        clocktesting.NewFakeClock(now),
+				k8sClient:    k8sClient,
+				lockIdentity: "test",
+				intervals:    defaultIntervals(),
+				logger:       microloggertest.New(),
+				namespace:    runCommandNamespace,
+			}
+
+			_, unlock, err := m.Lock(context.Background())
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+
+			if !tc.expectedOwner {
+				return
+			}
+
+			lease, err := k8sClient.CoordinationV1().Leases(runCommandNamespace).Get(context.Background(), lockLease, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("%s: expected nil got %#v", tc.name, err)
+			}
+			if *lease.Spec.HolderIdentity != "test" {
+				t.Fatalf("%s: expected holder %q got %q", tc.name, "test", *lease.Spec.HolderIdentity)
+			}
+
+			unlock()
+
+			_, err = k8sClient.CoordinationV1().Leases(runCommandNamespace).Get(context.Background(), lockLease, metav1.GetOptions{})
+			if !k8serrors.IsNotFound(err) {
+				t.Fatalf("%s: expected lock to be released got %#v", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_Migrator_renewLease(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	clk := clocktesting.NewFakeClock(now)
+	k8sClient := fake.NewSimpleClientset()
+
+	var mutex sync.Mutex
+	var apiDown bool
+	k8sClient.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if apiDown {
+			return true, nil, fmt.Errorf("simulated API outage")
+		}
+
+		// the fake clientset does not check resource versions, so a renewal
+		// conflicts when the lease got taken over
+		if action.GetVerb() == "update" {
+			obj, err := k8sClient.Tracker().Get(action.GetResource(), action.GetNamespace(), lockLease)
+			if err == nil && *obj.(*coordinationv1.Lease).Spec.HolderIdentity != "test" {
+				return true, nil, k8serrors.NewConflict(action.GetResource().GroupResource(), lockLease, fmt.Errorf("simulated conflict"))
+			}
+		}
+
+		return false, nil, nil
+	})
+
+	m := &Migrator{
+		clock:        clk,
+		k8sClient:    k8sClient,
+		lockIdentity: "test",
+		intervals:    defaultIntervals(),
+		logger:       microloggertest.New(),
+		namespace:    runCommandNamespace,
+	}
+
+	ctx, unlock, err := m.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	defer unlock()
+
+	// waitRenewing returns once the renewal is waiting for the clock or the
+	// lock got lost
+	waitRenewing := func() {
+		for !clk.HasWaiters() && ctx.Err() == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	step := func() {
+		clk.Step(defaultIntervals().lockRenew)
+		waitRenewing()
+	}
+	waitRenewing()
+
+	// the lock is kept while the API is down for longer than the lease
+	mutex.Lock()
+	apiDown = true
+	mutex.Unlock()
+	for clk.Since(now) < defaultIntervals().lockLease*3 {
+		step()
+	}
+	mutex.Lock()
+	apiDown = false
+	mutex.Unlock()
+	step()
+	if ctx.Err() != nil {
+		t.Fatalf("expected lock to be kept got %#v", context.Cause(ctx))
+	}
+
+	// the lock is lost once another migrator took the lease over
+	_, err = k8sClient.CoordinationV1().Leases(runCommandNamespace).Update(context.Background(), testLease("other", clk.Now()), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	step()
+	if !IsLockHeld(context.Cause(ctx)) {
+		t.Fatalf("expected lock held error got %#v", context.Cause(ctx))
+	}
+}
+
+func testLease(holder string, renewTime time.Time) *coordinationv1.Lease {
+	duration := int32(defaultIntervals().lockLease.Seconds())
+
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      lockLease,
+			Namespace: runCommandNamespace,
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &metav1.MicroTime{Time: renewTime},
+		},
+	}
+}
+
+func Test_Migrator_Run_ApiDownLongerThanLease(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	m := h.newMigrator()
+	m.intervals.lockLease = time.Millisecond * 50
+	m.intervals.lockRenew = time.Millisecond * 10
+	// the API check outlasts the outage
+	m.intervals.apiRetry = time.Millisecond * 100
+
+	// the API goes down while the data of the second member syncs, for
+	// longer than the lease
+	var mutex sync.Mutex
+	var downUntil time.Time
+	var failedRenewals int
+	h.k8sClient.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if downUntil.IsZero() && action.GetVerb() == "list" && action.GetResource().Resource == "nodes" {
+			resp, err := h.etcdClient.MemberList(context.Background())
+			if err == nil && len(resp.Members) == 2 {
+				downUntil = time.Now().Add(m.intervals.lockLease * 6)
+			}
+		}
+		if time.Now().Before(downUntil) {
+			if action.GetResource().Resource == "leases" {
+				failedRenewals++
+			}
+			return true, nil, fmt.Errorf("simulated API outage")
+		}
+
+		return false, nil, nil
+	})
+
+	err := m.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if failedRenewals == 0 {
+		t.Fatalf("expected lock renewals to fail while the API is down")
+	}
+}
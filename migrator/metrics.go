@@ -0,0 +1,156 @@
+package migrator
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "etcd_cluster_migrator"
+
+	phaseDiscover      = "discover"
+	phaseManageHosts   = "manage-hosts"
+	phaseFixPeerURL    = "fix-peer-url"
+	phaseCheckNetwork  = "check-network"
+	phaseCheckClock    = "check-clock"
+	phaseCheckVersion  = "check-version"
+	phaseDefragment    = "defragment"
+	phaseIssueCerts    = "issue-certificates"
+	phaseVerifyCerts   = "verify-certificates"
+	phaseCheckDisk     = "check-disk"
+	phaseConfigureNode = "configure-node"
+	phaseAddMember     = "add-member"
+	phaseSync          = "sync"
+	phaseRecover       = "recover"
+	phaseSucceeded     = "succeeded"
+	phaseFailed        = "failed"
+)
+
+var phases = []string{
+	phaseDiscover,
+	phaseManageHosts,
+	phaseFixPeerURL,
+	phaseCheckNetwork,
+	phaseCheckClock,
+	phaseCheckVersion,
+	phaseDefragment,
+	phaseIssueCerts,
+	phaseVerifyCerts,
+	phaseCheckDisk,
+	phaseConfigureNode,
+	phaseAddMember,
+	phaseSync,
+	phaseRecover,
+	phaseSucceeded,
+	phaseFailed,
+}
+
+var (
+	phaseGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "phase",
+			Help:      "Current phase of the migration, 1 for the active phase and 0 for all others.",
+		},
+		[]string{"phase"},
+	)
+	stepDurationGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "step_duration_seconds",
+			Help:      "Duration of the last execution of a migration step.",
+		},
+		[]string{"step", "node"},
+	)
+	memberCountGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "member_count",
+			Help:      "Number of members in the etcd cluster as last observed.",
+		},
+	)
+	jobRetriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_retries_total",
+			Help:      "Number of times a run-command job was recreated.",
+		},
+		[]string{"node"},
+	)
+	apiUnavailableCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_unavailable_seconds_total",
+			Help:      "Time the Kubernetes API was observed unavailable while waiting for the etcd data sync.",
+		},
+	)
+	successGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "success",
+			Help:      "Result of the last migration run, 1 for success and 0 for failure.",
+		},
+	)
+	completionTimeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_completion_timestamp_seconds",
+			Help:      "Unix time of the last finished migration run, successful or not.",
+		},
+	)
+)
+
+// registry holds only the migration metrics, without the Go runtime and
+// process metrics of the default registry, which are meaningless once pushed
+// for a short-lived Job.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	collectors := []prometheus.Collector{
+		phaseGauge,
+		stepDurationGauge,
+		memberCountGauge,
+		jobRetriesCounter,
+		apiUnavailableCounter,
+		successGauge,
+		completionTimeGauge,
+	}
+	prometheus.MustRegister(collectors...)
+	registry.MustRegister(collectors...)
+}
+
+// Gatherer returns the migration metrics to be pushed to a Pushgateway.
+func Gatherer() prometheus.Gatherer {
+	return registry
+}
+
+// setPhase marks the given phase as the active one.
+func setPhase(phase string) {
+	for _, p := range phases {
+		if p == phase {
+			phaseGauge.WithLabelValues(p).Set(1)
+		} else {
+			phaseGauge.WithLabelValues(p).Set(0)
+		}
+	}
+}
+
+// observeStep records the duration of a step.
+func observeStep(step string, node string, d time.Duration) {
+	stepDurationGauge.WithLabelValues(step, node).Set(d.Seconds())
+}
+
+// ObserveResult records the final result of a migration run. Run records its
+// own result, so it is only needed for runs which failed before, e.g. because
+// the migrator could not be created.
+func ObserveResult(err error) {
+	if err != nil {
+		setPhase(phaseFailed)
+		successGauge.Set(0)
+	} else {
+		setPhase(phaseSucceeded)
+		successGauge.Set(1)
+	}
+	completionTimeGauge.SetToCurrentTime()
+}
@@ -2,158 +2,845 @@ package migrator
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/giantswarm/backoff"
 	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
 	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 )
 
 const (
-	maxRetriesApi   = 20
-	maxRetriesNodes = 100
+	maxRetriesApi       = 20
+	maxRetriesMemberAdd = 12
+	maxRetriesNodes     = 100
 
-	masterNodeCount         = 3
-	masterNodeFetchInterval = time.Second * 10
+	defaultMemberCount = 3
 
-	waitApiStartInterval = time.Second * 30
-	waitApiRetryInterval = time.Second * 5
+	memberChangeTimeout = time.Second * 30
+	memberHealthTimeout = time.Second * 5
 )
 
 type MigratorConfig struct {
-	BaseDomain        string
-	DockerRegistry    string
-	EtcdCaFile        string
+	// Clock is used for all waiting done by the migrator. Defaults to the
+	// real clock.
+	Clock clock.Clock
+	// EtcdClient is used to change the etcd cluster membership. When nil, a
+	// client is created from the EtcdCaFile, EtcdCertFile, EtcdEndpoint and
+	// EtcdKeyFile settings. The migrator only closes clients it created.
+	EtcdClient EtcdClient
+	// EventRecorder records migration events. When nil, events are written
+	// through K8sClient.
+	EventRecorder record.EventRecorder
+	// K8sClient is used to access the cluster the migrator runs in. An
+	// in-cluster client is created when nil.
+	K8sClient kubernetes.Interface
+	// NodeCommandRunner executes commands on the master nodes. Defaults to
+	// running privileged Jobs on the nodes. Issuing certificates requires
+	// a NodeCommandFileRunner.
+	NodeCommandRunner NodeCommandRunner
+
+	BaseDomain string
+	// ClockSkewLimit is the offset of a master node clock to the migrator
+	// clock above which the migration does not start. Defaults to one
+	// second, a negative value disables the clock check.
+	ClockSkewLimit time.Duration
+	// ClockSkewWarning is the offset of a master node clock to the migrator
+	// clock above which a warning is logged. Defaults to 500ms.
+	ClockSkewWarning time.Duration
+	// CommandJob configures the Jobs executing commands on the master nodes
+	// when no NodeCommandRunner is injected.
+	CommandJob CommandJobConfig
+	// CompactRetention is the number of revisions kept when the etcd
+	// history is compacted before defragmenting. Defaults to 1000, a
+	// negative value defragments without compacting.
+	CompactRetention int64
+	// Defragment compacts the etcd history and defragments the database of
+	// the single member before the first member gets added, so that the
+	// snapshot sent to the new members gets smaller.
+	Defragment bool
+	// DiskSpaceFactor is the multiple of the etcd database size which must
+	// be free in the etcd data directory of a node before its member gets
+	// added. Defaults to 2, a negative value disables the check.
+	DiskSpaceFactor float64
+	DockerRegistry  string
+	EtcdCaFile      string
+	// EtcdCaKeyFile is the path of the PEM encoded private key of the CA in
+	// EtcdCaFile. When it or EtcdCaKeySecret is set, peer and server
+	// certificates are issued for every added member instead of verifying
+	// the certificates on its node.
+	EtcdCaKeyFile string
+	// EtcdCaKeySecret is the namespace/name of a Secret holding the private
+	// key of the CA in EtcdCaFile in its tls.key entry.
+	EtcdCaKeySecret   string
 	EtcdCertFile      string
 	EtcdEndpoint      string
 	EtcdKeyFile       string
 	EtcdStartingIndex int
-	MasterNodeLabel   string
+	// FsyncLatencyLimit is the 99th percentile of the fsync latency of the
+	// etcd data directory of a node above which its member is not added.
+	// Defaults to 10ms, a negative value disables the check.
+	FsyncLatencyLimit time.Duration
+	// JobName and JobNamespace identify the Job the migrator runs in. When
+	// set, migration events are recorded against it in addition to the master
+	// nodes.
+	JobName      string
+	JobNamespace string
+	Logger       micrologger.Logger
+	// ManageHostsFile installs the etcd peer hosts of all planned members
+	// into /etc/hosts on every master node, resolving to the internal IPs of
+	// the nodes running them. It is meant for environments where the etcd
+	// DNS names are not provisioned.
+	ManageHostsFile bool
+	// MasterNodeLabels are label selectors matching the master nodes. Nodes
+	// matching any of them are masters. Defaults to the control-plane, the
+	// legacy master and the role=master labels, so that whichever scheme the
+	// cluster uses is detected.
+	MasterNodeLabels []string
+	// MasterIDLabel is the key of the numeric node label ordering the master
+	// nodes. Defaults to giantswarm.io/master-id.
+	MasterIDLabel string
+	// MemberCount is the desired number of etcd members. Defaults to 3.
+	MemberCount int
+	// MemberNodes maps etcd member indexes, e.g. 1 for etcd1, to the names of
+	// the master nodes running them. Members which are not mapped run on the
+	// remaining master nodes in order.
+	MemberNodes map[int]string
+	// NodeCertFiles are the paths of the etcd server and peer certificates on
+	// the master nodes, verified before a node joins the etcd cluster.
+	// Defaults to /etc/kubernetes/ssl/etcd/server-crt.pem.
+	NodeCertFiles []string
+	// NodeOrder lists the master node names in the order they become etcd
+	// members. It takes precedence over MasterIDLabel.
+	NodeOrder []string
+	// Recovery is executed when the etcd cluster lost quorum because a
+	// member added by the migrator did not start. Either RecoveryRetryNode,
+	// RecoveryForceNewCluster or empty to only report the lost quorum.
+	Recovery string
+	// RecoveryConfirmation must be set to the base domain to confirm
+	// RecoveryForceNewCluster.
+	RecoveryConfirmation string
+	// SkipVersionCheck disables comparing the etcd version of the nodes
+	// about to join with the version of the etcd cluster.
+	SkipVersionCheck bool
 }
 
 type Migrator struct {
 	baseDomain        string
+	clockSkewLimit    time.Duration
+	clockSkewWarning  time.Duration
+	compactRetention  int64
+	defragment        bool
+	diskSpaceFactor   float64
 	dockerRegistry    string
 	etcdStartingIndex int
-	masterNodeLabel   string
+	fsyncLatencyLimit time.Duration
+	jobName           string
+	jobNamespace      string
+	lockIdentity      string
+	// namespace is the namespace of the run-command Jobs, the migration
+	// lock and the migration state.
+	namespace string
+	// intervals are the durations the migrator waits for.
+	intervals intervals
+	// stateLoaded is true once the state of the previous migration got
+	// loaded, which must happen before the state is saved.
+	stateLoaded      bool
+	manageHostsFile  bool
+	masterNodeLabels []string
+	memberCount      int
+	nodeCertFiles    []string
+	nodeSelection    nodeSelection
+	recovery         string
+	skipVersionCheck bool
+	// certIssuer issues the etcd certificates of added members. It is nil
+	// when no CA key is configured, or until it got loaded from
+	// etcdCaKeySecret.
+	certIssuer      *certIssuer
+	etcdCaFile      string
+	etcdCaKeySecret string
+	// etcdCA verifies the etcd certificates of the nodes. It is nil when no
+	// CA file is configured.
+	etcdCA *x509.CertPool
+
+	// etcdClientURL returns the client URL of the member with the given
+	// index.
+	etcdClientURL func(index int) string
+	// etcdPeerURL returns the peer URL of the member with the given index.
+	etcdPeerURL func(index int) string
+	// nodeClientURLs returns the client URLs of the etcd running on the
+	// given node.
+	nodeClientURLs func(node *apiv1.Node) []string
+
+	clock         clock.Clock
+	commandRunner NodeCommandRunner
+	etcdClient    EtcdClient
+	eventRecorder record.EventRecorder
+	k8sClient     kubernetes.Interface
+	logger        micrologger.Logger
+	// closeClients closes the clients the migrator created.
+	closeClients func()
 
-	etcdClient *etcdclientv3.Client
-	k8sClient  kubernetes.Interface
+	// hostsInstalled is set once the etcd peer hosts have been installed on
+	// the master nodes.
+	hostsInstalled bool
+	// defragmented is set once the database of the single member has been
+	// compacted and defragmented.
+	defragmented bool
+	// preflightChecked is set once the clocks and etcd versions of the nodes
+	// have been checked.
+	preflightChecked bool
+	// job is the migrator's own Job, looked up at the start of Run.
+	job runtime.Object
+	// state records the phase the migrator is in, persisted when Run ends.
+	state migrationState
+}
+
+// WithClients returns the configuration with the Kubernetes and etcd clients
+// and the event recorder created for the fields which are empty, so that
+// several migrators can share them. The returned function closes the created
+// clients.
+func (c MigratorConfig) WithClients() (MigratorConfig, func(), error) {
+	closeClients := func() {}
+
+	if c.K8sClient == nil {
+		k8sClient, err := createK8SClient()
+		if err != nil {
+			return c, nil, microerror.Mask(err)
+		}
+		c.K8sClient = k8sClient
+	}
+
+	if c.EtcdClient == nil {
+		etcdClient, err := createEtcdClient(c.EtcdCaFile, c.EtcdCertFile, c.EtcdKeyFile, c.EtcdEndpoint)
+		if err != nil {
+			return c, nil, microerror.Mask(err)
+		}
+		c.EtcdClient = etcdClient
+		closeClients = func() { etcdClient.Close() }
+	}
+
+	if c.EventRecorder == nil {
+		var stopEvents func()
+		c.EventRecorder, stopEvents = newEventRecorder(c.K8sClient)
+		closeEtcdClient := closeClients
+		closeClients = func() {
+			stopEvents()
+			closeEtcdClient()
+		}
+	}
+
+	return c, closeClients, nil
 }
 
 func NewMigrator(config MigratorConfig) (*Migrator, error) {
 	if config.BaseDomain == "" {
 		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.BaseDomain must not be empty", config))
 	}
-	if config.DockerRegistry == "" {
+	if config.DockerRegistry == "" && config.CommandJob.Image == "" && config.NodeCommandRunner == nil {
 		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.DockerRegistry must not be empty", config))
 	}
-	if config.EtcdCaFile == "" {
-		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaFile must not be empty", config))
+	if config.EtcdClient == nil {
+		if config.EtcdCaFile == "" {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaFile must not be empty", config))
+		}
+		if config.EtcdCertFile == "" {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCertFile must not be empty", config))
+		}
+		if config.EtcdEndpoint == "" {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdEndpoint must not be empty", config))
+		}
+		if config.EtcdKeyFile == "" {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdKeyFile must not be empty", config))
+		}
 	}
-	if config.EtcdCertFile == "" {
-		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCertFile must not be empty", config))
+	if config.Logger == nil {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.Logger must not be empty", config))
 	}
-	if config.EtcdEndpoint == "" {
-		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdEndpoint must not be empty", config))
+	if config.ClockSkewLimit == 0 {
+		config.ClockSkewLimit = defaultClockSkewLimit
 	}
-	if config.EtcdKeyFile == "" {
-		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdKeyFile must not be empty", config))
+	if config.ClockSkewWarning == 0 {
+		config.ClockSkewWarning = defaultClockSkewWarning
 	}
-
-	etcdClient, err := createEtcdClient(config.EtcdCaFile, config.EtcdCertFile, config.EtcdKeyFile, config.EtcdEndpoint)
+	if config.CompactRetention == 0 {
+		config.CompactRetention = defaultCompactRetention
+	}
+	if config.DiskSpaceFactor == 0 {
+		config.DiskSpaceFactor = defaultDiskSpaceFactor
+	}
+	if config.FsyncLatencyLimit == 0 {
+		config.FsyncLatencyLimit = defaultFsyncLatencyLimit
+	}
+	if config.MasterIDLabel == "" {
+		config.MasterIDLabel = labelMasterID
+	}
+	if len(config.NodeCertFiles) == 0 {
+		config.NodeCertFiles = []string{nodeEtcdCertFile}
+	}
+	if len(config.MasterNodeLabels) == 0 {
+		config.MasterNodeLabels = defaultMasterNodeLabels
+	}
+	if config.MemberCount == 0 {
+		config.MemberCount = defaultMemberCount
+	}
+	if config.MemberCount < 2 {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.MemberCount must be at least 2", config))
+	}
+	if len(config.NodeOrder) > 0 && len(config.NodeOrder) < config.MemberCount {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.NodeOrder must contain at least %d nodes", config, config.MemberCount))
+	}
+	memberNodes := map[int]string{}
+	for index, name := range config.MemberNodes {
+		position := index - config.EtcdStartingIndex
+		if position < 0 || position >= config.MemberCount {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.MemberNodes contains member index %d outside of %d to %d", config, index, config.EtcdStartingIndex, config.EtcdStartingIndex+config.MemberCount-1))
+		}
+		for _, other := range memberNodes {
+			if other == name {
+				return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.MemberNodes maps node %s to more than one member", config, name))
+			}
+		}
+		memberNodes[position] = name
+	}
+	err := config.CommandJob.validate()
 	if err != nil {
 		return nil, microerror.Mask(err)
 	}
+	if config.EtcdCaKeyFile != "" && config.EtcdCaKeySecret != "" {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaKeyFile and %T.EtcdCaKeySecret must not both be set", config, config))
+	}
+	if (config.EtcdCaKeyFile != "" || config.EtcdCaKeySecret != "") && config.EtcdCaFile == "" {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaFile must not be empty to issue certificates", config))
+	}
+	if (config.EtcdCaKeyFile != "" || config.EtcdCaKeySecret != "") && config.NodeCommandRunner != nil {
+		// issued private keys must not be passed as commands
+		_, ok := config.NodeCommandRunner.(NodeCommandFileRunner)
+		if !ok {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.NodeCommandRunner must implement NodeCommandFileRunner to issue certificates", config))
+		}
+	}
+	if config.EtcdCaKeySecret != "" {
+		_, _, err := splitSecretName(config.EtcdCaKeySecret)
+		if err != nil {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaKeySecret must be given as namespace/name", config))
+		}
+	}
+	if config.Recovery != "" && config.Recovery != RecoveryRetryNode && config.Recovery != RecoveryForceNewCluster {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.Recovery must be one of %q or %q", config, RecoveryRetryNode, RecoveryForceNewCluster))
+	}
+	if config.Recovery == RecoveryForceNewCluster && config.RecoveryConfirmation != config.BaseDomain {
+		return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.RecoveryConfirmation must be set to the base domain %q to force a new etcd cluster, which drops all members but the first one", config, config.BaseDomain))
+	}
+
+	if config.Clock == nil {
+		config.Clock = clock.RealClock{}
+	}
 
-	k8sClient, err := createK8SClient()
+	var etcdCA *x509.CertPool
+	if config.EtcdCaFile != "" {
+		etcdCA, err = CertPoolFromFile(config.EtcdCaFile)
+		if err != nil {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaFile could not be loaded: %s", config, err))
+		}
+	}
+
+	var issuer *certIssuer
+	if config.EtcdCaKeyFile != "" {
+		issuer, err = certIssuerFromFiles(config.EtcdCaFile, config.EtcdCaKeyFile)
+		if err != nil {
+			return nil, microerror.Maskf(invalidConfigError, fmt.Sprintf("%T.EtcdCaKeyFile could not be loaded: %s", config, err))
+		}
+	}
+
+	config, closeClients, err := config.WithClients()
 	if err != nil {
 		return nil, microerror.Mask(err)
 	}
 
+	commandJob := config.CommandJob.withDefaults(config.DockerRegistry)
+	if config.NodeCommandRunner == nil {
+		config.NodeCommandRunner = &jobCommandRunner{
+			clock:     config.Clock,
+			config:    commandJob,
+			k8sClient: config.K8sClient,
+			logger:    config.Logger,
+		}
+	}
+
 	m := &Migrator{
 		baseDomain:        config.BaseDomain,
+		clockSkewLimit:    config.ClockSkewLimit,
+		clockSkewWarning:  config.ClockSkewWarning,
+		compactRetention:  config.CompactRetention,
+		defragment:        config.Defragment,
+		diskSpaceFactor:   config.DiskSpaceFactor,
 		dockerRegistry:    config.DockerRegistry,
 		etcdStartingIndex: config.EtcdStartingIndex,
-		masterNodeLabel:   config.MasterNodeLabel,
+		fsyncLatencyLimit: config.FsyncLatencyLimit,
+		intervals:         defaultIntervals(),
+		jobName:           config.JobName,
+		jobNamespace:      config.JobNamespace,
+		lockIdentity:      lockIdentity(),
+		manageHostsFile:   config.ManageHostsFile,
+		masterNodeLabels:  config.MasterNodeLabels,
+		memberCount:       config.MemberCount,
+		namespace:         commandJob.Namespace,
+		nodeCertFiles:     config.NodeCertFiles,
+		nodeSelection: nodeSelection{
+			masterIDLabel: config.MasterIDLabel,
+			memberCount:   config.MemberCount,
+			memberNodes:   memberNodes,
+			nodeOrder:     config.NodeOrder,
+		},
+		recovery:         config.Recovery,
+		skipVersionCheck: config.SkipVersionCheck,
+		certIssuer:       issuer,
+		etcdCaFile:       config.EtcdCaFile,
+		etcdCaKeySecret:  config.EtcdCaKeySecret,
+		etcdCA:           etcdCA,
 
-		etcdClient: etcdClient,
-		k8sClient:  k8sClient,
+		etcdClientURL: func(index int) string {
+			return etcdClientURL(index, config.BaseDomain)
+		},
+		etcdPeerURL: func(index int) string {
+			return etcdPeerName(index, config.BaseDomain)
+		},
+		nodeClientURLs: nodeClientURLs,
+
+		clock:         config.Clock,
+		commandRunner: config.NodeCommandRunner,
+		etcdClient:    config.EtcdClient,
+		eventRecorder: config.EventRecorder,
+		k8sClient:     config.K8sClient,
+		logger:        config.Logger,
+
+		closeClients: closeClients,
 	}
 
 	return m, nil
 }
 
-func (m *Migrator) Run() error {
-	defer m.etcdClient.Close()
-	ctx := context.Background()
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*20)
-	defer cancel()
+// Run executes all pending migration steps until the etcd cluster has the
+// desired number of members. It holds the migration lock while doing so and
+// refuses to start when another migrator holds it. When the given context is
+// cancelled, Run stops waiting, lets etcd membership changes which are
+// already in flight complete and persists the phase it stopped in.
+func (m *Migrator) Run(ctx context.Context) error {
+	return m.RunWithProgress(ctx, nil)
+}
 
-	nodeNames, err := getMasterNodes(ctx, m.k8sClient, m.masterNodeLabel)
+// RunWithProgress is Run calling the given function, if any, before every
+// migration step, e.g. to report the progress of the migration. An error
+// returned by the function stops the migration.
+func (m *Migrator) RunWithProgress(ctx context.Context, progress func(ctx context.Context) error) error {
+	defer m.Close()
+
+	// the Kubernetes API is usually backed by the etcd cluster, so a lost
+	// quorum is recovered before anything needs the API
+	err := m.recoverLostQuorum(ctx)
 	if err != nil {
+		ObserveResult(err)
+		m.state.Error = err.Error()
+		m.state.Interrupted = ctx.Err() != nil
+		m.persistState(ctx)
 		return microerror.Mask(err)
 	}
 
-	memberListResponse, err := m.etcdClient.Cluster.MemberList(ctxWithTimeout)
+	job, err := m.lookupJob(ctx)
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to look up job %s/%s, events will only be recorded against nodes", m.jobNamespace, m.jobName)
+	} else {
+		m.job = job
+	}
+
+	ctx, unlock, err := m.Lock(ctx)
 	if err != nil {
+		ObserveResult(err)
+		m.recordJobEvent(apiv1.EventTypeWarning, eventReasonMigrationFailed, "etcd cluster migration did not start: %s", err)
 		return microerror.Mask(err)
 	}
-	memberCount := len(memberListResponse.Members)
+	defer unlock()
 
-	fmt.Printf("Found %d etcd members in the cluster.\n", memberCount)
+	m.loadPreviousState(ctx)
 
-	if memberCount == masterNodeCount {
-		fmt.Printf("Etcd cluster already has 3 nodes. Nothing to do. Exiting.\n")
-		return nil
-	} else if memberCount == 2 {
-		// continue migration that was interrupted in the middle of the process
-		err = m.addNodeToEtcdCluster(ctx, nodeNames, 3)
+	err = m.run(ctx, progress)
+	if IsLockHeld(context.Cause(ctx)) {
+		err = context.Cause(ctx)
+	}
+	ObserveResult(err)
+	if err != nil {
+		m.state.Error = err.Error()
+		m.state.Interrupted = ctx.Err() != nil
+		if m.state.Interrupted {
+			m.logger.LogCtx(ctx, "level", "warning", "message", "etcd cluster migration was interrupted", "step", m.state.Phase, "node", m.state.Node)
+		}
+		m.persistState(ctx)
+		m.recordJobEvent(apiv1.EventTypeWarning, eventReasonMigrationFailed, "etcd cluster migration failed in phase %s: %s", m.state.Phase, err)
+		return microerror.Mask(err)
+	}
+	m.enterPhase(phaseSucceeded, "")
+	m.persistState(ctx)
+	m.recordJobEvent(apiv1.EventTypeNormal, eventReasonMigrationDone, "etcd cluster migration successfully finished")
+
+	return nil
+}
+
+// loadPreviousState logs where the previous migration stopped and takes the
+// backups it recorded over into the current state.
+func (m *Migrator) loadPreviousState(ctx context.Context) {
+	if m.stateLoaded {
+		return
+	}
+
+	previous, err := m.loadState(ctx)
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to load migration state")
+		return
+	}
+	if previous.Phase != "" && previous.Phase != phaseSucceeded {
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("previous migration stopped in phase %s at %s (interrupted: %t)", previous.Phase, previous.UpdatedAt, previous.Interrupted), "step", previous.Phase, "node", previous.Node)
+	}
+	// backups are kept in the state until they are cleaned up
+	m.state.Backups = append(previous.Backups, m.state.Backups...)
+	for position, name := range previous.MemberNodes {
+		if _, ok := m.state.MemberNodes[position]; !ok {
+			m.setMemberNode(position, name)
+		}
+	}
+	m.stateLoaded = true
+}
+
+// persistState saves the current state and only logs failures, as the state
+// is informational and must not fail the migration. The previous state is
+// loaded first if that failed before, e.g. while the Kubernetes API was
+// down, so that its backups are not overwritten.
+func (m *Migrator) persistState(ctx context.Context) {
+	m.loadPreviousState(ctx)
+	if !m.stateLoaded {
+		return
+	}
+
+	err := m.saveState(ctx)
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to save migration state")
+	}
+}
+
+func (m *Migrator) run(ctx context.Context, progress func(ctx context.Context) error) error {
+	for {
+		// only stop in between steps when cancelled, so that a step never
+		// gets started when the migrator is about to terminate
+		if ctx.Err() != nil {
+			return microerror.Mask(ctx.Err())
+		}
+		if progress != nil {
+			err := progress(ctx)
+			if err != nil {
+				return microerror.Mask(err)
+			}
+		}
+
+		done, err := m.RunStep(ctx)
 		if err != nil {
 			return microerror.Mask(err)
 		}
+		if done {
+			break
+		}
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", "etcd cluster migration successfully finished")
+	return nil
+}
+
+// Close releases the clients created by the migrator. Injected clients are
+// left open.
+func (m *Migrator) Close() {
+	m.closeClients()
+}
+
+// RunStep executes the next pending migration step, which is either fixing
+// the peer URL of the first member or adding the next node to the etcd
+// cluster. It returns true when the etcd cluster already has the desired
+// number of members and there is nothing left to do. The caller must hold
+// the migration lock, as Run does.
+func (m *Migrator) RunStep(ctx context.Context) (bool, error) {
+	m.enterPhase(phaseDiscover, "")
+
+	// the etcd cluster is checked first, as the Kubernetes API is not
+	// available when it lost quorum
+	members, err := m.memberList(ctx)
+	if err != nil {
+		stuckIndex, detectErr := m.detectStuckMember(ctx)
+		if detectErr != nil {
+			m.logger.Errorf(ctx, detectErr, "failed to check etcd cluster for lost quorum")
+		} else if stuckIndex != 0 {
+			err = m.recoverQuorum(ctx, stuckIndex, true)
+			if err != nil {
+				return false, microerror.Mask(err)
+			}
+			return false, nil
+		}
+		return false, microerror.Mask(err)
+	}
 
-	} else if memberCount == 1 {
-		//  ensure that first node has proper etcd peer url set to etcd1.xxxx.xxxx.xxx
-		err = m.fixFirstNodePeerUrl(ctx, memberListResponse.Members)
+	if len(members) < m.memberCount || !allStarted(members) {
+		err = m.recordFirstMemberNode(ctx, members)
 		if err != nil {
-			return microerror.Mask(err)
+			return false, microerror.Mask(err)
+		}
+	}
+
+	nodeNames, err := m.getMasterNodes(ctx)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	memberCount := len(members)
+	memberCountGauge.Set(float64(memberCount))
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("found %d etcd members in the cluster", memberCount), "step", phaseDiscover)
+
+	if memberCount == m.memberCount && allStarted(members) {
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd cluster has %d members, nothing to do", memberCount), "step", phaseDiscover)
+		return true, nil
+	} else if memberCount < 1 || memberCount > m.memberCount {
+		m.logger.LogCtx(ctx, "level", "error", "message", "unexpected number of members in etcd cluster", "step", phaseDiscover)
+		return false, microerror.Maskf(executionFailedError, fmt.Sprintf("found %d nodes in etcd cluster", memberCount))
+	}
+
+	m.recordMemberNodes(ctx, nodeNames, members)
+
+	// the peer hosts must resolve before the first member advertises its
+	// peer URL
+	if m.manageHostsFile && !m.hostsInstalled {
+		m.enterPhase(phaseManageHosts, "")
+
+		err = m.installHostsEntries(ctx, nodeNames)
+		if err != nil {
+			return false, microerror.Mask(err)
 		}
-		// add second node to the etcd cluster
-		err = m.addNodeToEtcdCluster(ctx, nodeNames, 2)
+		m.hostsInstalled = true
+	}
+
+	//  ensure that first node has proper etcd peer url set to etcd1.xxxx.xxxx.xxx
+	if memberCount == 1 && !hasPeerURL(members[0], m.etcdPeerURL(m.etcdStartingIndex)) {
+		err = m.fixFirstNodePeerUrl(ctx, nodeNames[0], members)
 		if err != nil {
-			return microerror.Mask(err)
+			return false, microerror.Mask(err)
 		}
+		return false, nil
+	}
+
+	// the next node is the first one without a started member, which
+	// continues a migration that was interrupted in the middle of adding a
+	// node
+	nodeCount := 0
+	for i := 1; i < m.memberCount; i++ {
+		member := findMember(members, m.etcdPeerURL(m.etcdStartingIndex+i))
+		if member == nil || member.Name == "" {
+			nodeCount = i + 1
+			break
+		}
+	}
+	if nodeCount == 0 {
+		return false, microerror.Maskf(executionFailedError, "found %d members in etcd cluster but all planned members are started", memberCount)
+	}
+	peerURL := m.etcdPeerURL(m.etcdStartingIndex + nodeCount - 1)
+
+	// adding a member while another one has not started yet leaves the
+	// cluster without quorum as soon as the new member is registered. Only
+	// the member of the next node, registered by an interrupted run, may be
+	// pending.
+	for _, member := range members {
+		if member.Name == "" && !hasPeerURL(member, peerURL) {
+			return false, microerror.Maskf(quorumRiskError, "member %x with peer URLs %s has not started, refusing to add another member", member.ID, member.PeerURLs)
+		}
+	}
 
-		// add third node to the etcd cluster
-		err = m.addNodeToEtcdCluster(ctx, nodeNames, 3)
+	// the node of every new member must reach all members started before
+	// it, so its network is checked right before the member gets added
+	m.enterPhase(phaseCheckNetwork, nodeNames[nodeCount-1])
+
+	err = m.checkNodeNetwork(ctx, nodeNames[nodeCount-1:nodeCount], members)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+
+	// the clocks and etcd versions are checked once before the first member
+	// gets added
+	if !m.preflightChecked {
+		m.enterPhase(phaseCheckClock, "")
+
+		err = m.checkNodeClocks(ctx, nodeNames)
+		if err != nil {
+			return false, microerror.Mask(err)
+		}
+
+		m.enterPhase(phaseCheckVersion, "")
+
+		err = m.checkNodeVersions(ctx, nodeNames[nodeCount-1:])
+		if err != nil {
+			return false, microerror.Mask(err)
+		}
+		m.preflightChecked = true
+	}
+
+	// the database is shrunk while only the first member has to be
+	// defragmented, after the nodes passed the checks
+	if m.defragment && !m.defragmented && memberCount == 1 {
+		m.enterPhase(phaseDefragment, "")
+
+		err = m.compactAndDefragment(ctx, nodeNames[0])
+		if err != nil {
+			return false, microerror.Mask(err)
+		}
+		m.defragmented = true
+	}
+
+	err = m.addNodeToEtcdCluster(ctx, nodeNames, nodeCount)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+
+	return false, nil
+}
+
+// Status returns the etcd members and the master nodes they belong to.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	// the recorded member nodes keep their positions
+	m.loadPreviousState(ctx)
+
+	nodeNames, err := m.getMasterNodes(ctx)
+	if err != nil {
+		return Status{}, microerror.Mask(err)
+	}
+
+	members, err := m.memberList(ctx)
+	if err != nil {
+		return Status{}, microerror.Mask(err)
+	}
+
+	s := Status{
+		MemberCount: m.memberCount,
+		NodeNames:   nodeNames,
+	}
+	for _, member := range members {
+		ms := MemberStatus{
+			ID:       member.ID,
+			Name:     member.Name,
+			PeerURLs: member.PeerURLs,
+			// unstarted members have no name until they join the cluster
+			Started: member.Name != "",
+		}
+		for i, nodeName := range nodeNames {
+			if hasPeerURL(member, m.etcdPeerURL(m.etcdStartingIndex+i)) {
+				ms.NodeName = nodeName
+			}
+		}
+		s.Members = append(s.Members, ms)
+	}
+
+	return s, nil
+}
+
+func (m *Migrator) memberList(ctx context.Context) ([]*etcdserver.Member, error) {
+	memberListResponse, err := m.memberListResponse(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return memberListResponse.Members, nil
+}
+
+// memberListResponse returns the etcd members along with the response header
+// containing the cluster ID.
+func (m *Migrator) memberListResponse(ctx context.Context) (*etcdclientv3.MemberListResponse, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*20)
+	defer cancel()
+
+	memberListResponse, err := m.etcdClient.MemberList(ctxWithTimeout)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return memberListResponse, nil
+}
+
+// waitForMemberStarted waits until the member with the given peer URL has
+// started.
+func (m *Migrator) waitForMemberStarted(ctx context.Context, peerURL string) error {
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesApi, m.intervals.memberStart))
+	o := func() error {
+		members, err := m.memberList(ctx)
 		if err != nil {
 			return microerror.Mask(err)
 		}
-	} else {
-		fmt.Printf("unexpected number of nodes in etcd cluster\n")
-		return microerror.Maskf(executionFailedError, fmt.Sprintf("found %d nodes in etcd cluster", memberCount))
+		member := findMember(members, peerURL)
+		if member == nil || member.Name == "" {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("member %s has not started yet, retrying in %.2fs", peerURL, m.intervals.memberStart.Seconds()), "step", phaseSync)
+			return microerror.Mask(executionFailedError)
+		}
+
+		return nil
+	}
+	err := retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return microerror.Mask(ctx.Err())
+	} else if err != nil {
+		return microerror.Maskf(timeoutError, "member %s did not start after %d retries", peerURL, maxRetriesApi)
 	}
 
-	fmt.Printf("ETCD cluster migration succesfuly finished.\n\n")
 	return nil
 }
 
+// isMemberHealthy returns true if one of the client URLs of the given member
+// serves its status without reporting errors.
+func (m *Migrator) isMemberHealthy(ctx context.Context, member *etcdserver.Member) bool {
+	for _, u := range member.ClientURLs {
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, memberHealthTimeout)
+		resp, err := m.etcdClient.Status(ctxWithTimeout, u)
+		cancel()
+		if err == nil && len(resp.Errors) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
 // fixFirstNodePeerUrl ensure the peerURL for the first node in etcdcluster is properly set
 // as it can have 'localhost' value from the previous version fo k8scloudconfig.
-func (m *Migrator) fixFirstNodePeerUrl(ctx context.Context, etcdMembers []*etcdserver.Member) error {
+func (m *Migrator) fixFirstNodePeerUrl(ctx context.Context, nodeName string, etcdMembers []*etcdserver.Member) error {
+	m.enterPhase(phaseFixPeerURL, nodeName)
+	start := m.clock.Now()
+	defer func() { observeStep(phaseFixPeerURL, "", m.clock.Since(start)) }()
+
 	id := etcdMembers[0].ID
-	peerUrls := []string{etcdPeerName(m.etcdStartingIndex, m.baseDomain)}
+	peerUrls := []string{m.etcdPeerURL(m.etcdStartingIndex)}
 
-	_, err := m.etcdClient.Cluster.MemberUpdate(ctx, id, peerUrls)
+	// the membership change is not cancelled once started
+	updateCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), memberChangeTimeout)
+	defer cancel()
+
+	_, err := m.etcdClient.MemberUpdate(updateCtx, id, peerUrls)
 	if err != nil {
+		m.recordNodeEvent(nodeName, apiv1.EventTypeWarning, eventReasonStepFailed, "failed to update first member peer URLs to %s: %s", peerUrls, err)
 		return microerror.Mask(err)
 	}
-	fmt.Printf("Updated first node PeerUrls to %s.\n", peerUrls)
+	m.recordNodeEvent(nodeName, apiv1.EventTypeNormal, eventReasonPeerURLFixed, "updated first member %x peer URLs to %s", id, peerUrls)
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("updated first member peer URLs to %s", peerUrls), "step", phaseFixPeerURL, "memberID", fmt.Sprintf("%x", id))
 	return nil
 }
 
@@ -161,111 +848,333 @@ func (m *Migrator) fixFirstNodePeerUrl(ctx context.Context, etcdMembers []*etcds
 // to join the existing cluster via k8s job executed on the node and after that
 // it will add the node to the etcd cluster via etcdv3 client API.
 
-func (m *Migrator) addNodeToEtcdCluster(ctx context.Context, nodeNames []string, nodeCount int) error {
-	// nodeCount can only be 2 or 3
+func (m *Migrator) addNodeToEtcdCluster(ctx context.Context, nodeNames []string, nodeCount int) (err error) {
+	// nodeCount is the number of members after adding the node, e.g.
 	// 2 when adding second node to a single node etcd cluster
 	// 3 when adding third node to two node etcd cluster
-	if nodeCount != 2 && nodeCount != 3 {
-		return microerror.Maskf(executionFailedError, "nodeCount can only have values 2 or 3")
+	if nodeCount < 2 || nodeCount > m.memberCount {
+		return microerror.Maskf(executionFailedError, "nodeCount must be between 2 and %d", m.memberCount)
 	}
 
-	if len(nodeNames) != 3 {
-		return microerror.Maskf(executionFailedError, "nodeNames len must be 3")
+	if len(nodeNames) != m.memberCount {
+		return microerror.Maskf(executionFailedError, "nodeNames len must be %d", m.memberCount)
 	}
 
-	// execute commands on the node to configure new etcd3 member so that it can join the existing cluster
+	nodeName := nodeNames[nodeCount-1]
+	defer func() {
+		if err != nil {
+			m.recordNodeEvent(nodeName, apiv1.EventTypeWarning, eventReasonStepFailed, "failed to add node to etcd cluster: %s", err)
+		}
+	}()
+
+	nodeIndex := m.etcdStartingIndex + nodeCount - 1
+	peerUrls := []string{m.etcdPeerURL(nodeIndex)}
+
+	// a previous run may have registered the member already, in which case
+	// it is reused instead of being added again
+	var existing *etcdserver.Member
+	var members []*etcdserver.Member
+	var clusterID uint64
 	{
-		nodeName := nodeNames[nodeCount-1]
+		resp, err := m.memberListResponse(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		members = resp.Members
+		clusterID = resp.Header.ClusterId
+		existing = findMember(members, peerUrls[0])
+
+		if existing != nil && existing.Name != "" {
+			if !m.isMemberHealthy(ctx, existing) {
+				return microerror.Maskf(executionFailedError, "member %x with peer URLs %s is started but not healthy, refusing to reconfigure node %s", existing.ID, existing.PeerURLs, nodeName)
+			}
+			m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("member %s is already started and healthy, nothing to do", existing.PeerURLs), "step", phaseAddMember, "node", nodeName, "memberID", fmt.Sprintf("%x", existing.ID))
+			return nil
+		}
+	}
+
+	// the certificates are issued or verified before the node is changed,
+	// so that a member is never added for a node which can not join with
+	// them
+	var certs *memberCertificates
+	{
+		issuer, err := m.loadCertIssuer(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
 
-		// the final sed command may look like this:
-		// sed -i 's/--initial-cluster .*\\/--initial-cluster etcd1=https://etcd1.clusterd.domain.io:2380,etcd1=https://etcd2.clusterd.domain.io:2380/g' /etc/systemd/system/etcd3.service'
-		sedReplaceRegEx := "--initial-cluster .*\\\\"
-		sedReplaceWith := fmt.Sprintf("--initial-cluster %s\\\\", initialCluster(m.etcdStartingIndex, m.baseDomain, nodeCount))
-		sedInitialClusterCmd := fmt.Sprintf("sed -i 's/%s/%s/g' /etc/systemd/system/etcd3.service", sedReplaceRegEx, sedReplaceWith)
+		if issuer != nil {
+			m.enterPhase(phaseIssueCerts, nodeName)
 
-		commands := []string{
-			"systemctl stop etcd3",          // stop etcd3 service
-			"rm -rf /var/lib/etcd/member",   // ensure the data folder is empty
-			sedInitialClusterCmd,            // sed command to properly set initialCluster string
-			"systemctl daemon-reload",       // load new etcd3 service file
-			"systemctl start etcd3.service", // restart etcd3, after this etcd3 will start syncing data from the cluster
+			certs, err = m.issueNodeCertificates(ctx, issuer, nodeName, nodeIndex)
+			if err != nil {
+				return microerror.Mask(err)
+			}
+		} else {
+			m.enterPhase(phaseVerifyCerts, nodeName)
+
+			err = m.verifyNodeCertificates(ctx, nodeName, nodeIndex)
+			if err != nil {
+				return microerror.Mask(err)
+			}
 		}
+	}
 
-		fmt.Printf("Configuring node %s for etcd cluster.\n", nodeName)
+	{
+		m.enterPhase(phaseCheckDisk, nodeName)
+
+		err := m.checkNodeDisk(ctx, nodeName)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	// execute commands on the node to configure new etcd3 member so that it can join the existing cluster
+	{
+		m.enterPhase(phaseConfigureNode, nodeName)
+		start := m.clock.Now()
+
+		err := m.checkNodeEtcd(ctx, nodeName, clusterID, members)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		backupPath := m.backupPath()
+		commands, files := configureNodeCommands(m.etcdStartingIndex, m.baseDomain, nodeCount, backupPath, certs)
+		m.setMemberNode(nodeCount-1, nodeName)
+		m.recordBackup(ctx, nodeName, backupPath)
+
+		m.logger.LogCtx(ctx, "level", "info", "message", "configuring node for etcd cluster", "step", phaseConfigureNode, "node", nodeName)
 		// execute commands above on the node via k8s job
-		err := m.runCommandsOnNode(ctx, nodeName, commands)
+		if len(files) > 0 {
+			runner, ok := m.commandRunner.(NodeCommandFileRunner)
+			if !ok {
+				return microerror.Maskf(executionFailedError, "node command runner can not write the issued certificates to node %s", nodeName)
+			}
+			err = runner.RunCommandsWithFiles(ctx, nodeName, files, commands)
+		} else {
+			err = m.commandRunner.RunCommands(ctx, nodeName, commands)
+		}
 		if err != nil {
 			return microerror.Mask(err)
 		}
+		observeStep(phaseConfigureNode, nodeName, m.clock.Since(start))
+		m.recordNodeEvent(nodeName, apiv1.EventTypeNormal, eventReasonNodeConfigured, "configured etcd3 service to join etcd cluster %s", initialCluster(m.etcdStartingIndex, m.baseDomain, nodeCount))
 	}
 
-	nodeIndex := m.etcdStartingIndex + nodeCount - 1
 	// add the new node to the etcd cluster via etcd client API
-	{
-		peerUrls := []string{etcdPeerName(nodeIndex, m.baseDomain)}
-		r, err := m.etcdClient.Cluster.MemberAdd(ctx, peerUrls)
+	if existing != nil {
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("member %s is already registered in the etcd cluster, reusing it", existing.PeerURLs), "step", phaseAddMember, "node", nodeName, "memberID", fmt.Sprintf("%x", existing.ID))
+	} else {
+		m.enterPhase(phaseAddMember, nodeName)
+		start := m.clock.Now()
+
+		member, err := m.addMember(ctx, peerUrls)
 		if err != nil {
 			return microerror.Mask(err)
 		}
-		fmt.Printf("Added new member %s to the etcd cluster.\n", r.Member.PeerURLs)
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("added new member %s to the etcd cluster", member.PeerURLs), "step", phaseAddMember, "node", nodeName, "memberID", fmt.Sprintf("%x", member.ID))
+		observeStep(phaseAddMember, nodeName, m.clock.Since(start))
+		m.recordNodeEvent(nodeName, apiv1.EventTypeNormal, eventReasonMemberAdded, "added etcd member %x with peer URLs %s", member.ID, member.PeerURLs)
 	}
 
 	// wait until k8s api is available again, as etcd data sync will make API unavailable for short time
-	err := waitForApiAvailable(ctx, m.k8sClient)
+	{
+		m.enterPhase(phaseSync, nodeName)
+		start := m.clock.Now()
+
+		err := m.waitForApiAvailable(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		// the member must have started before the next step looks at the
+		// cluster, otherwise the node would be considered pending and
+		// configured again
+		err = m.waitForMemberStarted(ctx, peerUrls[0])
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		observeStep(phaseSync, nodeName, m.clock.Since(start))
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", "etcd cluster synced, node successfully joined etcd cluster", "step", phaseSync, "node", nodeName)
+	m.recordNodeEvent(nodeName, apiv1.EventTypeNormal, eventReasonSyncComplete, "etcd cluster synced, node successfully joined etcd cluster")
+
+	return nil
+}
+
+// addMember adds a member with the given peer URLs to the etcd cluster. etcd
+// refuses membership changes as long as a recently started member is not
+// considered healthy yet, so the change is retried in that case. A member
+// which got registered in the meantime is returned instead of failing.
+func (m *Migrator) addMember(ctx context.Context, peerUrls []string) (*etcdserver.Member, error) {
+	var member *etcdserver.Member
+
+	o := func() error {
+		// the membership change is not cancelled once started
+		addCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), memberChangeTimeout)
+		defer cancel()
+
+		r, err := m.etcdClient.MemberAdd(addCtx, peerUrls)
+		if err == nil {
+			member = r.Member
+			return nil
+		} else if err == rpctypes.ErrPeerURLExist {
+			members, err := m.memberList(ctx)
+			if err != nil {
+				return microerror.Mask(err)
+			}
+			member = findMember(members, peerUrls[0])
+			if member == nil {
+				return backoff.Permanent(microerror.Maskf(executionFailedError, "etcd reports peer URLs %s as registered but no member has them", peerUrls))
+			}
+			return nil
+		} else if err == rpctypes.ErrUnhealthy {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("etcd cluster is not healthy yet, retrying in %.2fs", m.intervals.memberAddRetry.Seconds()), "step", phaseAddMember)
+			return microerror.Mask(err)
+		} else if err != nil {
+			return backoff.Permanent(microerror.Mask(err))
+		}
+
+		return nil
+	}
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesMemberAdd, m.intervals.memberAddRetry))
+
+	err := retry(m.clock, o, b)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return member, nil
+}
+
+// recordFirstMemberNode maps the position of the first member to the master
+// node it runs on, unless it is mapped already. The node is found by asking
+// the etcd of every master for its member ID, and falls back to the node
+// configured for the first member. Once mapped, the node keeps its position
+// even when it is cordoned or not ready, as the first member keeps running
+// on it.
+func (m *Migrator) recordFirstMemberNode(ctx context.Context, members []*etcdserver.Member) error {
+	if _, ok := m.state.MemberNodes[0]; ok {
+		return nil
+	}
+
+	// the peer URL of a single member may not be fixed yet
+	first := findMember(members, m.etcdPeerURL(m.etcdStartingIndex))
+	if first == nil && len(members) == 1 {
+		first = members[0]
+	}
+	if first == nil {
+		return microerror.Maskf(preflightFailedError, "etcd cluster has no member with peer URL %s", m.etcdPeerURL(m.etcdStartingIndex))
+	}
+
+	nodes, err := m.listMasterNodes(ctx)
 	if err != nil {
 		return microerror.Mask(err)
 	}
 
-	fmt.Printf("Etcd cluster synced, node %s succesfully joined etcd cluster.\n", nodeNames[nodeCount-1])
+	nodeName, found := "", false
+	for i := range nodes {
+		for _, endpoint := range m.nodeClientURLs(&nodes[i]) {
+			s, err := m.memberStatus(ctx, endpoint)
+			if err == nil && s.Header.MemberId == first.ID {
+				nodeName, found = nodes[i].Name, true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		nodeName, found = m.nodeSelection.configuredNode(0)
+	}
+	if !found {
+		return microerror.Maskf(preflightFailedError, "failed to find the master node running etcd member %x, configure its node as member %d", first.ID, m.etcdStartingIndex)
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd member %x runs on node %s", first.ID, nodeName), "step", phaseDiscover, "node", nodeName)
+	m.setMemberNode(0, nodeName)
+	m.persistState(ctx)
 
 	return nil
 }
 
-func getMasterNodes(ctx context.Context, c kubernetes.Interface, labelSelector string) ([]string, error) {
+// getMasterNodes waits until there are enough eligible master nodes and
+// returns the names of the nodes running the etcd members in the order they
+// become members.
+func (m *Migrator) getMasterNodes(ctx context.Context) ([]string, error) {
 	var nodeNames []string
 
-	b := backoff.NewMaxRetries(maxRetriesNodes, masterNodeFetchInterval)
+	count := m.memberCount
+	logger := m.logger
+
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesNodes, m.intervals.masterNodeFetch))
 	o := func() error {
-		nodeList, err := c.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		nodes, err := m.listMasterNodes(ctx)
 		if err != nil {
 			return microerror.Mask(err)
 		}
-		if len(nodeList.Items) == masterNodeCount {
-			nodeNames = getNodeNames(nodeList.Items)
-			fmt.Printf("Found %d masters %s, %s, %s.\n", masterNodeCount, nodeNames[0], nodeNames[1], nodeNames[2])
+
+		selected, skipped, err := selectMasterNodes(nodes, m.nodeSelection, m.state.MemberNodes)
+		if err != nil {
+			return backoff.Permanent(microerror.Mask(err))
+		}
+		for _, n := range skipped {
+			logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("skipping master %s, it is %s", n.name, n.reason), "step", phaseDiscover, "node", n.name)
+		}
+
+		if selected != nil {
+			nodeNames = selected
+			logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("found %d masters %s", count, strings.Join(nodeNames, ", ")), "step", phaseDiscover)
 			return nil
 		} else {
-			fmt.Printf("Found %d masters but expected %d. Retrying in %.2fs\n", len(nodeList.Items), masterNodeCount, masterNodeFetchInterval.Seconds())
+			logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("found %d eligible masters but expected %d, retrying in %.2fs", len(nodes)-len(skipped), count, m.intervals.masterNodeFetch.Seconds()), "step", phaseDiscover)
 			return microerror.Mask(executionFailedError)
 		}
 	}
-	err := backoff.Retry(o, b)
-	if err != nil {
-		fmt.Printf("Failed to reach k8s API after %d retries.\n", maxRetriesApi)
+	err := retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return nil, microerror.Mask(ctx.Err())
+	} else if IsPreflightFailed(err) || IsInvalidConfig(err) {
 		return nil, microerror.Mask(err)
+	} else if err != nil {
+		logger.Errorf(ctx, err, "failed to find %d masters after %d retries", count, maxRetriesNodes)
+		return nil, microerror.Maskf(timeoutError, "failed to find %d masters after %d retries", count, maxRetriesNodes)
 	}
 	return nodeNames, nil
 }
 
 // waitForApiAvailable wait until k8s api is available which indicates that etcd cluster is synced with the new member.
-func waitForApiAvailable(ctx context.Context, c kubernetes.Interface) error {
-	fmt.Printf("Waiting for the etcd data sync.\n")
-	time.Sleep(waitApiStartInterval)
+func (m *Migrator) waitForApiAvailable(ctx context.Context) error {
+	m.logger.LogCtx(ctx, "level", "info", "message", "waiting for the etcd data sync", "step", phaseSync)
+	err := sleep(ctx, m.clock, m.intervals.apiStart)
+	if err != nil {
+		return microerror.Mask(err)
+	}
 
-	b := backoff.NewMaxRetries(maxRetriesApi, waitApiRetryInterval)
+	var unavailableSince time.Time
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesApi, m.intervals.apiRetry))
 	o := func() error {
-		_, err := c.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		_, err := m.k8sClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if !unavailableSince.IsZero() {
+			apiUnavailableCounter.Add(m.clock.Since(unavailableSince).Seconds())
+			unavailableSince = time.Time{}
+		}
 		if err != nil {
-			fmt.Printf("API is still down. retrying in %.2f.\n", waitApiRetryInterval.Seconds())
+			unavailableSince = m.clock.Now()
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("API is still down, retrying in %.2fs", m.intervals.apiRetry.Seconds()), "step", phaseSync)
 			return microerror.Mask(err)
 		}
 
 		return nil
 	}
-	err := backoff.Retry(o, b)
-	if err != nil {
-		fmt.Printf("Failed to reach k8s API after %d retries.\n", maxRetriesApi)
-		return microerror.Mask(err)
+	err = retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return microerror.Mask(ctx.Err())
+	} else if err != nil {
+		m.logger.Errorf(ctx, err, "failed to reach k8s API after %d retries", maxRetriesApi)
+		return microerror.Maskf(timeoutError, "failed to reach k8s API after %d retries", maxRetriesApi)
 	}
 
 	return nil
@@ -0,0 +1,429 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_Migrator_Run(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		startedMembers int
+		expectedEvents []string
+	}{
+		{
+			name:           "case 0: migrate single member cluster to 3 members",
+			startedMembers: 1,
+			expectedEvents: []string{
+				eventReasonPeerURLFixed,
+				eventReasonMemberAdded,
+				eventReasonSyncComplete,
+			},
+		},
+		{
+			name:           "case 1: resume migration of 2 member cluster",
+			startedMembers: 2,
+			expectedEvents: []string{
+				eventReasonMemberAdded,
+				eventReasonSyncComplete,
+			},
+		},
+		{
+			name:           "case 2: nothing to do for 3 member cluster",
+			startedMembers: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := newTestHarness(t, tc.startedMembers)
+
+			err := h.newMigrator().Run(context.Background())
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+
+			h.waitForStartedMembers(testMemberCount)
+
+			resp, err := h.etcdClient.MemberList(context.Background())
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+			for i := 1; i <= testMemberCount; i++ {
+				var found bool
+				for _, member := range resp.Members {
+					if hasPeerURL(member, h.peerURL(i)) {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("expected member with peer URL %s", h.peerURL(i))
+				}
+			}
+
+			events := h.events()
+			for _, expected := range tc.expectedEvents {
+				if !contains(events, expected) {
+					t.Fatalf("expected event %s in %v", expected, events)
+				}
+			}
+			if len(tc.expectedEvents) == 0 && len(events) != 0 {
+				t.Fatalf("expected no events got %v", events)
+			}
+		})
+	}
+}
+
+func Test_Migrator_Run_PreflightChecks(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	// the database never fits the free space of the nodes
+	c := h.migratorConfig()
+	c.DiskSpaceFactor = 1e9
+
+	err := h.newMigratorWithConfig(c).Run(context.Background())
+	if !IsPreflightFailed(err) {
+		t.Fatalf("expected preflight failed error got %#v", err)
+	}
+
+	// the clock, disk and version checks read the logs of the run-command
+	// pods
+	var logs int
+	for _, a := range h.k8sClient.Actions() {
+		if a.GetVerb() == "get" && a.GetResource().Resource == "pods" && a.GetSubresource() == "log" {
+			logs++
+		}
+	}
+	if logs == 0 {
+		t.Fatalf("expected run-command pod logs to be read")
+	}
+
+	resp, err := h.etcdClient.MemberList(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if len(resp.Members) != 1 {
+		t.Fatalf("expected no member to be added got %d members", len(resp.Members))
+	}
+}
+
+func Test_Migrator_Run_FailureMidStep(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	// the third node can not be configured, so the migration stops after
+	// adding the second member
+	h.failJob(testNodeName(3), true)
+
+	err := h.newMigrator().Run(context.Background())
+	if err == nil {
+		t.Fatalf("expected error got nil")
+	}
+
+	h.waitForStartedMembers(2)
+
+	cm, err := h.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Get(context.Background(), stateConfigMap, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	var s migrationState
+	err = json.Unmarshal([]byte(cm.Data[stateKey]), &s)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if s.Phase != phaseConfigureNode || s.Node != testNodeName(3) || s.Error == "" || s.Interrupted {
+		t.Fatalf("expected failed %s phase on node %s got %#v", phaseConfigureNode, testNodeName(3), s)
+	}
+	// the backup is recorded before the failed job ran, it may already
+	// exist on the node
+	if len(s.Backups) != 2 || s.Backups[1].Node != testNodeName(3) {
+		t.Fatalf("expected backup of %s in state got %#v", testNodeName(3), s.Backups)
+	}
+
+	// a second run resumes the migration
+	h.failJob(testNodeName(3), false)
+
+	err = h.newMigrator().Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	h.waitForStartedMembers(testMemberCount)
+}
+
+func Test_Migrator_Run_MemberNodeNotReady(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+	h.failJob(testNodeName(3), true)
+
+	err := h.newMigrator().Run(context.Background())
+	if err == nil {
+		t.Fatalf("expected error got nil")
+	}
+	h.waitForStartedMembers(2)
+
+	// the node of a started member becoming not ready must not shift the
+	// positions of the other nodes
+	node, err := h.k8sClient.CoreV1().Nodes().Get(context.Background(), testNodeName(1), apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	*node = notReadyNode(*node)
+	_, err = h.k8sClient.CoreV1().Nodes().Update(context.Background(), node, apismetav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.failJob(testNodeName(3), false)
+
+	err = h.newMigrator().Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	memberNodes := h.state().MemberNodes
+	for position := 0; position < testMemberCount; position++ {
+		if memberNodes[position] != testNodeName(position+1) {
+			t.Fatalf("expected member nodes %s to %s got %#v", testNodeName(1), testNodeName(testMemberCount), memberNodes)
+		}
+	}
+}
+
+func Test_Migrator_Run_FirstMemberNodeCordoned(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	// the node of the first member is not eligible for new members, but
+	// keeps running the first member
+	node, err := h.k8sClient.CoreV1().Nodes().Get(context.Background(), testNodeName(1), apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	node.Spec.Unschedulable = true
+	_, err = h.k8sClient.CoreV1().Nodes().Update(context.Background(), node, apismetav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	err = h.newMigrator().Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	memberNodes := h.state().MemberNodes
+	for position := 0; position < testMemberCount; position++ {
+		if memberNodes[position] != testNodeName(position+1) {
+			t.Fatalf("expected member nodes %s to %s got %#v", testNodeName(1), testNodeName(testMemberCount), memberNodes)
+		}
+	}
+}
+
+func Test_Migrator_Run_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := h.newMigrator().Run(ctx)
+	if err == nil {
+		t.Fatalf("expected error got nil")
+	}
+
+	cm, err := h.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Get(context.Background(), stateConfigMap, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	var s migrationState
+	err = json.Unmarshal([]byte(cm.Data[stateKey]), &s)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if !s.Interrupted {
+		t.Fatalf("expected interrupted state got %#v", s)
+	}
+
+	h.waitForStartedMembers(1)
+}
+
+func Test_Migrator_Run_PendingMember(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 2)
+
+	// a previous run got interrupted after registering the third member but
+	// before its node was started
+	h.addMember(3)
+
+	err := h.newMigrator().Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	h.waitForStartedMembers(testMemberCount)
+
+	events := h.events()
+	if !contains(events, eventReasonNodeConfigured) {
+		t.Fatalf("expected event %s in %v", eventReasonNodeConfigured, events)
+	}
+	if contains(events, eventReasonMemberAdded) {
+		t.Fatalf("expected registered member to be reused got events %v", events)
+	}
+}
+
+func Test_Migrator_addNodeToEtcdCluster_StartedMember(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, testMemberCount)
+
+	r := &testCommandRunner{h: h}
+	m := h.newMigratorWithRunner(r)
+	defer m.Close()
+
+	nodeNames := []string{testNodeName(1), testNodeName(2), testNodeName(3)}
+	err := m.addNodeToEtcdCluster(context.Background(), nodeNames, testMemberCount)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	if len(r.nodeNames) != 0 {
+		t.Fatalf("expected started member not to be reconfigured got commands for %v", r.nodeNames)
+	}
+	if events := h.events(); len(events) != 0 {
+		t.Fatalf("expected no events got %v", events)
+	}
+}
+
+func Test_Migrator_Run_LockHeld(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 1)
+
+	_, err := h.k8sClient.CoordinationV1().Leases(runCommandNamespace).Create(context.Background(), testLease("other", time.Now()), apismetav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	err = h.newMigrator().Run(context.Background())
+	if !IsLockHeld(err) {
+		t.Fatalf("expected lock held error got %#v", err)
+	}
+
+	h.waitForStartedMembers(1)
+}
+
+func Test_Migrator_Run_Namespace(t *testing.T) {
+	t.Parallel()
+
+	const namespace = "etcd-migration"
+
+	h := newTestHarness(t, 2)
+
+	c := h.migratorConfig()
+	c.CommandJob.Namespace = namespace
+
+	// the lock is taken in the configured namespace only
+	lease := testLease("other", time.Now())
+	lease.Namespace = namespace
+	_, err := h.k8sClient.CoordinationV1().Leases(namespace).Create(context.Background(), lease, apismetav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	err = h.newMigratorWithConfig(c).Run(context.Background())
+	if !IsLockHeld(err) {
+		t.Fatalf("expected lock held error got %#v", err)
+	}
+	err = h.k8sClient.CoordinationV1().Leases(namespace).Delete(context.Background(), lockLease, apismetav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	_, err = h.k8sClient.CoordinationV1().Leases(runCommandNamespace).Create(context.Background(), testLease("other", time.Now()), apismetav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	err = h.newMigratorWithConfig(c).Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.waitForStartedMembers(testMemberCount)
+
+	_, err = h.k8sClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), stateConfigMap, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected migration state in %s got %#v", namespace, err)
+	}
+	_, err = h.k8sClient.CoreV1().ConfigMaps(runCommandNamespace).Get(context.Background(), stateConfigMap, apismetav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		t.Fatalf("expected no migration state in %s got %#v", runCommandNamespace, err)
+	}
+	for _, action := range h.k8sClient.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "jobs" && action.GetNamespace() != namespace {
+			t.Fatalf("expected jobs in %s got %s", namespace, action.GetNamespace())
+		}
+	}
+}
+
+func Test_Migrator_Run_NodeCommandRunner(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, 2)
+
+	r := &testCommandRunner{h: h}
+	err := h.newMigratorWithRunner(r).Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	h.waitForStartedMembers(testMemberCount)
+
+	// the etcd of the node is not running yet, so its data directory is
+	// checked before the node gets configured
+	if len(r.nodeNames) != 2 || r.nodeNames[0] != testNodeName(3) || r.nodeNames[1] != testNodeName(3) {
+		t.Fatalf("expected commands to run on %s only got %v", testNodeName(3), r.nodeNames)
+	}
+	if r.scripts[0] != "test ! -e "+etcdMemberDir {
+		t.Fatalf("expected data directory to be checked got script %s", r.scripts[0])
+	}
+	if strings.Contains(r.scripts[1], "rm -rf") || !strings.Contains(r.scripts[1], "mv "+etcdMemberDir) {
+		t.Fatalf("expected data directory to be moved to a backup got script %s", r.scripts[1])
+	}
+
+	s := h.state()
+	if len(s.Backups) != 1 || s.Backups[0].Node != testNodeName(3) || !strings.Contains(r.scripts[1], s.Backups[0].Path) {
+		t.Fatalf("expected backup of %s in state got %#v", testNodeName(3), s.Backups)
+	}
+	jobs, err := h.k8sClient.BatchV1().Jobs(runCommandNamespace).List(context.Background(), apismetav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Fatalf("expected no run-command jobs got %d", len(jobs.Items))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
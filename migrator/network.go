@@ -0,0 +1,254 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/giantswarm/microerror"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+const (
+	probeMarker = "### etcd-cluster-migrator probe "
+	// probeTimeout is the time in seconds a connection probe may take.
+	probeTimeout = 10
+
+	probeDNS    = "dns"
+	probePeer   = "peer"
+	probeClient = "client"
+)
+
+// probe is a check executed on a node, either resolving a planned peer host
+// or connecting to the peer or client URL of a member.
+type probe struct {
+	Kind   string
+	Target string
+}
+
+// probeResult is the exit code of a probe executed on a node.
+type probeResult struct {
+	Node  string
+	Probe probe
+	Code  int
+}
+
+// OK returns true if the probe succeeded.
+func (r probeResult) OK() bool {
+	return r.Code == 0
+}
+
+// Reason describes the exit code of the probe.
+func (r probeResult) Reason() string {
+	if r.Code == 0 {
+		return "ok"
+	}
+	if r.Code < 0 {
+		return "no result"
+	}
+
+	if r.Probe.Kind == probeDNS {
+		if r.Code == 2 {
+			return "not resolved"
+		}
+		return fmt.Sprintf("getent exit code %d", r.Code)
+	}
+
+	// exit codes of curl
+	switch r.Code {
+	case 6:
+		return "not resolved"
+	case 7:
+		return "connection failed"
+	case 28:
+		return "timed out"
+	case 35:
+		return "TLS handshake failed"
+	case 51, 60:
+		return "server certificate not trusted"
+	case 58:
+		return "client certificate rejected"
+	case 127:
+		return "curl not found"
+	}
+	return fmt.Sprintf("curl exit code %d", r.Code)
+}
+
+// checkNodeNetwork runs probes on the given nodes resolving the peer hosts
+// of all planned members and connecting to the peer and client URLs of the
+// given started members with TLS. The results are logged as a matrix of
+// nodes and targets, and the check fails when any probe failed.
+//
+// The probes are executed through the NodeCommandRunner, so the check is
+// skipped when it can not return the command output. Targets given as IP
+// addresses are not resolved, and loopback targets are not probed.
+func (m *Migrator) checkNodeNetwork(ctx context.Context, nodeNames []string, members []*etcdserver.Member) error {
+	probes := m.networkProbes(members)
+	if len(probes) == 0 {
+		return nil
+	}
+
+	runner, ok := m.commandRunner.(NodeCommandOutputRunner)
+	if !ok {
+		m.logger.LogCtx(ctx, "level", "warning", "message", "node command runner does not return output, skipping network check", "step", phaseCheckNetwork)
+		return nil
+	}
+
+	var results []probeResult
+	for _, nodeName := range nodeNames {
+		output, err := runner.RunCommandsWithOutput(ctx, nodeName, probeCommands(probes))
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		results = append(results, parseProbeResults(nodeName, probes, output)...)
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("network check results\n%s", formatProbeMatrix(nodeNames, probes, results)), "step", phaseCheckNetwork)
+
+	var failures []string
+	for _, r := range results {
+		if !r.OK() {
+			failures = append(failures, fmt.Sprintf("node %s %s %s: %s", r.Node, r.Probe.Kind, r.Probe.Target, r.Reason()))
+		}
+	}
+	if len(failures) > 0 {
+		return microerror.Maskf(preflightFailedError, "network check failed: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// networkProbes returns the probes resolving the peer hosts of all planned
+// members and connecting to the URLs of the given started members.
+func (m *Migrator) networkProbes(members []*etcdserver.Member) []probe {
+	var probes []probe
+	for i := 0; i < m.memberCount; i++ {
+		u, err := url.Parse(m.etcdPeerURL(m.etcdStartingIndex + i))
+		if err != nil || net.ParseIP(u.Hostname()) != nil || u.Hostname() == "localhost" {
+			continue
+		}
+		probes = append(probes, probe{Kind: probeDNS, Target: u.Hostname()})
+	}
+
+	for _, member := range members {
+		if member.Name == "" {
+			continue
+		}
+		for _, u := range member.PeerURLs {
+			if p, ok := connectionProbe(probePeer, u); ok {
+				probes = append(probes, p)
+			}
+		}
+		for _, u := range member.ClientURLs {
+			if p, ok := connectionProbe(probeClient, u); ok {
+				probes = append(probes, p)
+			}
+		}
+	}
+
+	return probes
+}
+
+// connectionProbe returns the probe connecting to the given URL. It returns
+// false for URLs without TLS or on the loopback interface, which do not
+// tell whether the member can be reached from other nodes.
+func connectionProbe(kind string, rawURL string) (probe, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return probe{}, false
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || ip != nil && ip.IsLoopback() {
+		return probe{}, false
+	}
+
+	return probe{Kind: kind, Target: u.Host}, true
+}
+
+// probeCommands returns the commands executing the given probes. Every
+// command prints the exit code of its probe after probeMarker, as the
+// output also contains the trace of the executed script.
+func probeCommands(probes []probe) []string {
+	var commands []string
+	for _, p := range probes {
+		var check string
+		if p.Kind == probeDNS {
+			check = fmt.Sprintf("getent hosts %s >/dev/null 2>&1", p.Target)
+		} else {
+			check = fmt.Sprintf("curl -s -o /dev/null --max-time %d --cacert %s --cert %s --key %s https://%s/version", probeTimeout, nodeEtcdCaFile, nodeEtcdCertFile, nodeEtcdKeyFile, p.Target)
+		}
+		commands = append(commands, fmt.Sprintf(`sh -c '%s; echo "%s%s %s $?"'`, check, probeMarker, p.Kind, p.Target))
+	}
+
+	return commands
+}
+
+// parseProbeResults extracts the results of the given probes executed on the
+// given node from the output. Probes without result get the code -1.
+func parseProbeResults(nodeName string, probes []probe, output []byte) []probeResult {
+	codes := map[probe]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, probeMarker) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, probeMarker))
+		if len(fields) != 3 {
+			continue
+		}
+		code, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		codes[probe{Kind: fields[0], Target: fields[1]}] = code
+	}
+
+	var results []probeResult
+	for _, p := range probes {
+		code, ok := codes[p]
+		if !ok {
+			code = -1
+		}
+		results = append(results, probeResult{Node: nodeName, Probe: p, Code: code})
+	}
+
+	return results
+}
+
+// formatProbeMatrix returns a table of the given results with a row per node
+// and a column per probe.
+func formatProbeMatrix(nodeNames []string, probes []probe, results []probeResult) string {
+	reasons := map[string]map[probe]string{}
+	for _, r := range results {
+		if reasons[r.Node] == nil {
+			reasons[r.Node] = map[probe]string{}
+		}
+		reasons[r.Node][r.Probe] = r.Reason()
+	}
+
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+
+	header := []string{"NODE"}
+	for _, p := range probes {
+		header = append(header, fmt.Sprintf("%s %s", p.Kind, p.Target))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, nodeName := range nodeNames {
+		row := []string{nodeName}
+		for _, p := range probes {
+			row = append(row, reasons[nodeName][p])
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	return b.String()
+}
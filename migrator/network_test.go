@@ -0,0 +1,150 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func Test_Migrator_checkNodeNetwork(t *testing.T) {
+	members := []*etcdserver.Member{
+		{
+			ID:         1,
+			Name:       "etcd1",
+			PeerURLs:   []string{"https://etcd1.cluster.test:2380"},
+			ClientURLs: []string{"https://etcd1.cluster.test:2379", "https://127.0.0.1:2379"},
+		},
+		{
+			ID:       2,
+			PeerURLs: []string{"https://etcd2.cluster.test:2380"},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		codes        map[string]map[string]int
+		errorMatcher func(error) bool
+	}{
+		{
+			name: "case 0: all probes succeed",
+		},
+		{
+			name: "case 1: peer host is not resolved on one node",
+			codes: map[string]map[string]int{
+				"master-3": {"dns etcd2.cluster.test": 2},
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 2: peer port is not reachable",
+			codes: map[string]map[string]int{
+				"master-2": {"peer etcd1.cluster.test:2380": 7},
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name: "case 3: probe without result",
+			codes: map[string]map[string]int{
+				"master-2": {"client etcd1.cluster.test:2379": -1},
+			},
+			errorMatcher: IsPreflightFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := &testProbeRunner{codes: tc.codes}
+			m := &Migrator{
+				commandRunner:     r,
+				etcdStartingIndex: 1,
+				logger:            microloggertest.New(),
+				memberCount:       3,
+
+				etcdPeerURL: func(index int) string {
+					return etcdPeerName(index, "cluster.test")
+				},
+			}
+
+			err := m.checkNodeNetwork(context.Background(), []string{"master-2", "master-3"}, members)
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+
+			// the loopback client URL and the member which has not started
+			// are not probed
+			expected := []string{
+				"dns etcd1.cluster.test",
+				"dns etcd2.cluster.test",
+				"dns etcd3.cluster.test",
+				"peer etcd1.cluster.test:2380",
+				"client etcd1.cluster.test:2379",
+			}
+			if strings.Join(r.probes, ",") != strings.Join(expected, ",") {
+				t.Fatalf("%s: probes == %v, want %v", tc.name, r.probes, expected)
+			}
+		})
+	}
+}
+
+func Test_formatProbeMatrix(t *testing.T) {
+	probes := []probe{
+		{Kind: probeDNS, Target: "etcd2.cluster.test"},
+		{Kind: probePeer, Target: "etcd1.cluster.test:2380"},
+	}
+	results := []probeResult{
+		{Node: "master-2", Probe: probes[0], Code: 0},
+		{Node: "master-2", Probe: probes[1], Code: 28},
+	}
+
+	matrix := formatProbeMatrix([]string{"master-2"}, probes, results)
+
+	expected := "NODE      dns etcd2.cluster.test  peer etcd1.cluster.test:2380\n" +
+		"master-2  ok                      timed out\n"
+	if matrix != expected {
+		t.Fatalf("matrix ==\n%s\nwant\n%s", matrix, expected)
+	}
+}
+
+// testProbeRunner returns the output of probeCommands with the given exit
+// codes per node and probe, all other probes succeed. A negative code
+// omits the result of the probe.
+type testProbeRunner struct {
+	codes  map[string]map[string]int
+	probes []string
+}
+
+func (r *testProbeRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	return nil
+}
+
+func (r *testProbeRunner) RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error) {
+	r.probes = nil
+
+	var output strings.Builder
+	for _, c := range commands {
+		// the probe is the end of the echoed marker line
+		i := strings.Index(c, probeMarker)
+		p := strings.TrimSuffix(c[i+len(probeMarker):], ` $?"'`)
+		r.probes = append(r.probes, p)
+
+		code := r.codes[nodeName][p]
+		fmt.Fprintf(&output, "+ %s\n", c)
+		if code >= 0 {
+			fmt.Fprintf(&output, "%s%s %d\n", probeMarker, p, code)
+		}
+	}
+
+	return []byte(output.String()), nil
+}
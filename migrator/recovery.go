@@ -0,0 +1,427 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/backoff"
+	"github.com/giantswarm/microerror"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RecoveryRetryNode configures the node of the member which did not
+	// start again so that it can join the etcd cluster and restore quorum.
+	RecoveryRetryNode = "retry-node"
+	// RecoveryForceNewCluster restarts the etcd member of the first node
+	// with --force-new-cluster, which drops all other members and rolls the
+	// etcd cluster back to a single member.
+	RecoveryForceNewCluster = "force-new-cluster"
+
+	quorumCheckTimeout   = time.Second * 5
+	recoveryNodesTimeout = time.Second * 10
+)
+
+// recoverLostQuorum recovers an etcd cluster which lost quorum because a
+// member added by the migrator did not start. It runs before anything else
+// needs the Kubernetes API, which is usually down without quorum. The
+// recovery commands are only executed while holding the migration lock,
+// otherwise they are logged to be executed manually.
+func (m *Migrator) recoverLostQuorum(ctx context.Context) error {
+	_, err := m.memberList(ctx)
+	if err == nil {
+		return nil
+	}
+
+	stuckIndex, err := m.detectStuckMember(ctx)
+	if err != nil {
+		m.logger.Errorf(ctx, err, "failed to check etcd cluster for lost quorum")
+		return nil
+	} else if stuckIndex == 0 {
+		return nil
+	}
+
+	// without a recovery there is nothing to execute and no lock to take
+	if m.recovery == "" {
+		return microerror.Mask(m.recoverQuorum(ctx, stuckIndex, false))
+	}
+
+	lockCtx, unlock, err := m.lockForRecovery(ctx)
+	if IsLockHeld(err) || ctx.Err() != nil {
+		return microerror.Mask(err)
+	} else if err != nil {
+		m.logger.Errorf(ctx, err, "failed to take the migration lock, only logging the recovery commands")
+		return microerror.Mask(m.recoverQuorum(ctx, stuckIndex, false))
+	}
+	defer unlock()
+	ctx = lockCtx
+
+	m.loadPreviousState(ctx)
+
+	err = m.recoverQuorum(ctx, stuckIndex, true)
+	if IsLockHeld(context.Cause(ctx)) {
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// lockForRecovery takes the migration lock for the recovery, waiting a while
+// for the Kubernetes API to answer.
+func (m *Migrator) lockForRecovery(ctx context.Context) (context.Context, func(), error) {
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesApi, m.intervals.apiRetry))
+	o := func() error {
+		if !m.apiAvailable(ctx) {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("Kubernetes API is not available for the migration lock, retrying in %.2fs", m.intervals.apiRetry.Seconds()), "step", phaseRecover)
+			return microerror.Maskf(executionFailedError, "Kubernetes API is not available")
+		}
+
+		return nil
+	}
+	err := retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return nil, nil, microerror.Mask(ctx.Err())
+	} else if err != nil {
+		return nil, nil, microerror.Maskf(executionFailedError, "Kubernetes API is not available after %d retries", maxRetriesApi)
+	}
+
+	lockCtx, unlock, err := m.Lock(ctx)
+	if err != nil {
+		return nil, nil, microerror.Mask(err)
+	}
+
+	return lockCtx, unlock, nil
+}
+
+// apiAvailable returns true if the Kubernetes API answers within
+// recoveryNodesTimeout.
+func (m *Migrator) apiAvailable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, recoveryNodesTimeout)
+	defer cancel()
+
+	_, err := m.k8sClient.CoordinationV1().Leases(m.namespace).Get(ctx, lockLease, metav1.GetOptions{})
+	return err == nil || k8serrors.IsNotFound(err)
+}
+
+// detectStuckMember checks whether the etcd cluster lost quorum because a
+// member added by the migrator did not start. It returns the index of the
+// first planned member which is not serving the etcd cluster if the cluster
+// has no leader, and 0 otherwise.
+//
+// The membership can not be listed without quorum, so the planned members
+// are asked for their status directly instead.
+func (m *Migrator) detectStuckMember(ctx context.Context) (int, error) {
+	endpoints := m.etcdClient.Endpoints()
+	if len(endpoints) == 0 {
+		return 0, nil
+	}
+
+	first, err := m.memberStatus(ctx, endpoints[0])
+	if err != nil {
+		return 0, microerror.Mask(err)
+	}
+	if first.Leader != 0 {
+		return 0, nil
+	}
+
+	for i := 1; i < m.memberCount; i++ {
+		index := m.etcdStartingIndex + i
+
+		// an etcd which is running on its own belongs to another cluster
+		s, err := m.memberStatus(ctx, m.etcdClientURL(index))
+		if err != nil || s.Header.ClusterId != first.Header.ClusterId {
+			return index, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// clientStatus returns the status of the member behind the first endpoint of
+// the etcd client, which is the member the migrator started from.
+func (m *Migrator) clientStatus(ctx context.Context) (*etcdclientv3.StatusResponse, error) {
+	endpoints := m.etcdClient.Endpoints()
+	if len(endpoints) == 0 {
+		return nil, microerror.Maskf(executionFailedError, "etcd client has no endpoints")
+	}
+
+	s, err := m.memberStatus(ctx, endpoints[0])
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return s, nil
+}
+
+func (m *Migrator) memberStatus(ctx context.Context, endpoint string) (*etcdclientv3.StatusResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, quorumCheckTimeout)
+	defer cancel()
+
+	s, err := m.etcdClient.Status(ctx, endpoint)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return s, nil
+}
+
+// recoverQuorum executes the configured recovery for an etcd cluster which
+// lost quorum because the member with the given index did not start. Unless
+// the migration lock is held, the recovery commands are only logged.
+//
+// Recovery commands are executed through the NodeCommandRunner. As the
+// Kubernetes API is usually backed by the etcd cluster which lost quorum,
+// the default Job based runner may not work, so the commands are always
+// logged to be executed manually on the nodes. A NodeCommandRunner which
+// does not need the API recovers on its own when the nodes of the members
+// are configured.
+func (m *Migrator) recoverQuorum(ctx context.Context, stuckIndex int, locked bool) error {
+	nodeCount := stuckIndex - m.etcdStartingIndex + 1
+	stuckHost := etcdHost(stuckIndex, m.baseDomain)
+	firstHost := etcdHost(m.etcdStartingIndex, m.baseDomain)
+
+	m.logger.LogCtx(ctx, "level", "error", "message", fmt.Sprintf("etcd cluster lost quorum, the member on %s did not start", stuckHost), "step", phaseRecover)
+
+	switch m.recovery {
+	case RecoveryRetryNode:
+		m.enterPhase(phaseRecover, stuckHost)
+
+		backupPath := m.backupPath()
+		commands, _ := configureNodeCommands(m.etcdStartingIndex, m.baseDomain, nodeCount, backupPath, nil)
+		m.logRecoveryCommands(ctx, stuckHost, commands)
+		if !locked {
+			return unlockedRecoveryError(stuckHost)
+		}
+
+		nodeName, err := m.recoveryNode(ctx, nodeCount, stuckHost)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.recordBackup(ctx, nodeName, backupPath)
+		err = m.runRecoveryCommands(ctx, nodeName, stuckHost, commands)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		err = m.waitForQuorum(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd cluster regained quorum after configuring %s again", stuckHost), "step", phaseRecover)
+
+		return nil
+
+	case RecoveryForceNewCluster:
+		m.enterPhase(phaseRecover, firstHost)
+		m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("FORCING A NEW ETCD CLUSTER ON %s, ALL OTHER MEMBERS ARE DROPPED", firstHost), "step", phaseRecover)
+
+		// etcd of the member which did not start must not join the cluster
+		// once it comes up
+		backupPath := m.backupPath()
+		stuckCommands := append([]string{"systemctl stop etcd3"}, backupNodeCommands(backupPath)...)
+		forceCommands := forceNewClusterCommands(m.etcdStartingIndex, m.baseDomain)
+		cleanupCommands := removeForceNewClusterCommands()
+		var firstCommands []string
+		firstCommands = append(firstCommands, forceCommands...)
+		firstCommands = append(firstCommands, "# wait until etcdctl member list shows a single member")
+		firstCommands = append(firstCommands, cleanupCommands...)
+		m.logRecoveryCommands(ctx, stuckHost, stuckCommands)
+		m.logRecoveryCommands(ctx, firstHost, firstCommands)
+		if !locked {
+			return unlockedRecoveryError(stuckHost)
+		}
+
+		stuckNode, err := m.recoveryNode(ctx, nodeCount, stuckHost)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		firstNode, err := m.recoveryNode(ctx, 1, firstHost)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		m.recordBackup(ctx, stuckNode, backupPath)
+		err = m.runRecoveryCommands(ctx, stuckNode, stuckHost, stuckCommands)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		err = m.runRecoveryCommands(ctx, firstNode, firstHost, forceCommands)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		// the flag must stay until etcd rewrote its membership, otherwise
+		// a restart in between brings the dropped members back
+		err = m.waitForSingleMember(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		err = m.runRecoveryCommands(ctx, firstNode, firstHost, cleanupCommands)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		// the single member does not need the peer hosts of the dropped
+		// members, failing to remove them must not hide the rollback
+		if m.manageHostsFile {
+			err = m.removeHostsEntries(ctx)
+			if err != nil {
+				m.logger.Errorf(ctx, err, "failed to remove etcd peer hosts from the master nodes")
+			}
+		}
+
+		// the nodes of the dropped members do not run members anymore
+		for position := range m.state.MemberNodes {
+			if position != 0 {
+				delete(m.state.MemberNodes, position)
+			}
+		}
+
+		return microerror.Maskf(rollbackPerformedError, "forced etcd member on %s to a new single member cluster after the member on %s did not start", firstHost, stuckHost)
+
+	default:
+		return microerror.Maskf(quorumLostError, "the etcd member on %s did not start, recover by either running again with recovery %q to configure its node again, or with recovery %q and the base domain as confirmation to roll back to a single member", stuckHost, RecoveryRetryNode, RecoveryForceNewCluster)
+	}
+}
+
+// unlockedRecoveryError is returned when the recovery commands can not be
+// executed because the migration lock could not be taken.
+func unlockedRecoveryError(host string) error {
+	return microerror.Maskf(quorumLostError, "the etcd member on %s did not start and the migration lock could not be taken, execute the logged recovery commands on the nodes manually", host)
+}
+
+// logRecoveryCommands logs the given commands for the node of the given etcd
+// host, so that they can be executed manually when the Kubernetes API is not
+// available.
+func (m *Migrator) logRecoveryCommands(ctx context.Context, host string, commands []string) {
+	m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("recovery commands for the node of %s:\n%s", host, strings.Join(commands, "\n")), "step", phaseRecover)
+}
+
+// recoveryNode returns the name of the node of the member with the given
+// position, falling back to the configured member nodes when the master
+// nodes can not be listed.
+func (m *Migrator) recoveryNode(ctx context.Context, nodeCount int, host string) (string, error) {
+	nodeNames, err := m.recoveryNodeNames(ctx)
+	if err == nil {
+		return nodeNames[nodeCount-1], nil
+	}
+	if name, ok := m.nodeSelection.configuredNode(nodeCount - 1); ok {
+		m.logger.Errorf(ctx, err, "failed to look up master nodes, using configured node %s for %s", name, host)
+		return name, nil
+	}
+
+	return "", microerror.Maskf(quorumLostError, "failed to look up master nodes, execute the logged recovery commands on the node of %s manually or configure the member nodes: %s", host, err)
+}
+
+// runRecoveryCommands executes the given commands on the given node of the
+// member on the given host.
+func (m *Migrator) runRecoveryCommands(ctx context.Context, nodeName string, host string, commands []string) error {
+	err := m.commandRunner.RunCommands(ctx, nodeName, commands)
+	if err != nil {
+		return microerror.Maskf(quorumLostError, "failed to run recovery commands on node %s, execute the logged recovery commands manually: %s", nodeName, err)
+	}
+	m.recordNodeEvent(nodeName, apiv1.EventTypeWarning, eventReasonRecovered, "executed %s recovery commands for %s", m.recovery, host)
+
+	return nil
+}
+
+// recoveryNodeNames lists the master nodes once instead of waiting for them
+// to show up, as the Kubernetes API may be down.
+func (m *Migrator) recoveryNodeNames(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, recoveryNodesTimeout)
+	defer cancel()
+
+	nodes, err := m.listMasterNodes(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	nodeNames, _, err := selectMasterNodes(nodes, m.nodeSelection, m.state.MemberNodes)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if nodeNames == nil {
+		return nil, microerror.Maskf(executionFailedError, "found less than %d eligible masters", m.memberCount)
+	}
+
+	return nodeNames, nil
+}
+
+// waitForQuorum waits until the etcd membership can be listed again.
+func (m *Migrator) waitForQuorum(ctx context.Context) error {
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesApi, m.intervals.memberStart))
+	o := func() error {
+		_, err := m.memberList(ctx)
+		if err != nil {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("etcd cluster has no quorum yet, retrying in %.2fs", m.intervals.memberStart.Seconds()), "step", phaseRecover)
+			return microerror.Mask(err)
+		}
+
+		return nil
+	}
+	err := retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return microerror.Mask(ctx.Err())
+	} else if err != nil {
+		return microerror.Maskf(quorumLostError, "etcd cluster did not regain quorum after %d retries", maxRetriesApi)
+	}
+
+	return nil
+}
+
+// waitForSingleMember waits until the etcd cluster lists a single member,
+// which means that the member started with --force-new-cluster rewrote its
+// membership.
+func (m *Migrator) waitForSingleMember(ctx context.Context) error {
+	b := withContext(ctx, backoff.NewMaxRetries(maxRetriesApi, m.intervals.memberStart))
+	o := func() error {
+		members, err := m.memberList(ctx)
+		if err != nil {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("etcd cluster has no quorum yet, retrying in %.2fs", m.intervals.memberStart.Seconds()), "step", phaseRecover)
+			return microerror.Mask(err)
+		}
+		if len(members) != 1 {
+			m.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("etcd cluster still has %d members, retrying in %.2fs", len(members), m.intervals.memberStart.Seconds()), "step", phaseRecover)
+			return microerror.Maskf(executionFailedError, "etcd cluster has %d members", len(members))
+		}
+
+		return nil
+	}
+	err := retry(m.clock, o, b)
+	if ctx.Err() != nil {
+		return microerror.Mask(ctx.Err())
+	} else if err != nil {
+		return microerror.Maskf(quorumLostError, "etcd cluster did not shrink to a single member after %d retries, remove --force-new-cluster from %s once it did", maxRetriesApi, etcdServiceFile)
+	}
+
+	return nil
+}
+
+// forceNewClusterCommands returns the commands restarting the etcd member of
+// the first node with --force-new-cluster.
+func forceNewClusterCommands(startingIndex int, baseDomain string) []string {
+	return []string{
+		"systemctl stop etcd3",
+		sedInitialClusterCommand(initialCluster(startingIndex, baseDomain, 1) + " --force-new-cluster"),
+		"systemctl daemon-reload",
+		"systemctl start etcd3.service",
+	}
+}
+
+// removeForceNewClusterCommands returns the commands removing the
+// --force-new-cluster flag from the etcd3 service again once etcd rewrote its
+// membership, so that later restarts keep the data.
+func removeForceNewClusterCommands() []string {
+	return []string{
+		fmt.Sprintf("sed -i 's/ --force-new-cluster//g' %s", etcdServiceFile),
+		"systemctl daemon-reload",
+	}
+}
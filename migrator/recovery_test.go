@@ -0,0 +1,183 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_Migrator_Run_QuorumLost(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		recovery         string
+		apiDown          bool
+		memberNodes      map[int]string
+		errorMatcher     func(error) bool
+		expectedMembers  int
+		expectedCommands bool
+	}{
+		{
+			name:         "case 0: report lost quorum without recovery",
+			errorMatcher: IsQuorumLost,
+		},
+		{
+			name:             "case 1: configure node of stuck member again",
+			recovery:         RecoveryRetryNode,
+			expectedMembers:  testMemberCount,
+			expectedCommands: true,
+		},
+		{
+			name:             "case 2: force new cluster on first node",
+			recovery:         RecoveryForceNewCluster,
+			errorMatcher:     IsRollbackPerformed,
+			expectedMembers:  1,
+			expectedCommands: true,
+		},
+		{
+			name:         "case 3: only log the recovery commands without the API and the migration lock",
+			recovery:     RecoveryRetryNode,
+			apiDown:      true,
+			memberNodes:  map[int]string{1: testNodeName(1), 2: testNodeName(2), 3: testNodeName(3)},
+			errorMatcher: IsQuorumLost,
+		},
+		{
+			name:         "case 4: report lost quorum without the API and member nodes",
+			recovery:     RecoveryRetryNode,
+			apiDown:      true,
+			errorMatcher: IsQuorumLost,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := newTestHarness(t, 1)
+
+			// the second member gets added but never starts, which leaves
+			// the etcd cluster without quorum
+			_, err := h.etcdClient.MemberUpdate(context.Background(), h.memberID(1), []string{h.peerURL(1)})
+			if err != nil {
+				t.Fatalf("expected nil got %#v", err)
+			}
+			h.addMember(2)
+
+			if tc.apiDown {
+				// the Kubernetes API is backed by the etcd cluster
+				h.k8sClient.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+					defer cancel()
+
+					_, err := h.etcdClient.MemberList(ctx)
+					if err != nil {
+						return true, nil, fmt.Errorf("simulated API outage: %w", err)
+					}
+
+					return false, nil, nil
+				})
+			}
+
+			runner := &testCommandRunner{h: h}
+			c := h.migratorConfig()
+			c.NodeCommandRunner = runner
+			c.MemberNodes = tc.memberNodes
+			c.Recovery = tc.recovery
+			c.RecoveryConfirmation = testBaseDomain
+
+			err = h.newMigratorWithConfig(c).Run(context.Background())
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.expectedMembers != 0 {
+				h.waitForStartedMembers(tc.expectedMembers)
+			}
+			if tc.expectedCommands != (len(runner.scripts) != 0) {
+				t.Fatalf("expected recovery commands %t got %v", tc.expectedCommands, runner.scripts)
+			}
+		})
+	}
+}
+
+// phaseCommandRunner records the phase gauges while node commands are
+// executed.
+type phaseCommandRunner struct {
+	NodeCommandRunner
+
+	phases []map[string]float64
+}
+
+func (r *phaseCommandRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	values := map[string]float64{
+		phaseRecover: testutil.ToFloat64(phaseGauge.WithLabelValues(phaseRecover)),
+	}
+	for _, p := range phases {
+		values[p] = testutil.ToFloat64(phaseGauge.WithLabelValues(p))
+	}
+	r.phases = append(r.phases, values)
+
+	return r.NodeCommandRunner.RunCommands(ctx, nodeName, commands)
+}
+
+// Test_Migrator_Run_QuorumLost_PhaseMetric is not parallel, as the phase
+// gauge is shared by all migrators.
+func Test_Migrator_Run_QuorumLost_PhaseMetric(t *testing.T) {
+	h := newTestHarness(t, 1)
+
+	_, err := h.etcdClient.MemberUpdate(context.Background(), h.memberID(1), []string{h.peerURL(1)})
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+	h.addMember(2)
+
+	runner := &phaseCommandRunner{NodeCommandRunner: &testCommandRunner{h: h}}
+	c := h.migratorConfig()
+	c.NodeCommandRunner = runner
+	c.Recovery = RecoveryRetryNode
+
+	err = h.newMigratorWithConfig(c).Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+
+	if len(runner.phases) == 0 {
+		t.Fatalf("expected recovery commands got none")
+	}
+	for p, v := range runner.phases[0] {
+		expected := 0.0
+		if p == phaseRecover {
+			expected = 1
+		}
+		if v != expected {
+			t.Fatalf("expected phase gauge %s to be %v during recovery got %v", p, expected, v)
+		}
+	}
+}
+
+func Test_NewMigrator_ForceNewClusterConfirmation(t *testing.T) {
+	h := &testHarness{t: t}
+
+	c := h.migratorConfig()
+	c.Recovery = RecoveryForceNewCluster
+	c.RecoveryConfirmation = "wrong.domain"
+
+	_, err := NewMigrator(c)
+	if !IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error got %#v", err)
+	}
+}
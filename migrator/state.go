@@ -0,0 +1,141 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	etcdserver "go.etcd.io/etcd/api/v3/etcdserverpb"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/giantswarm/etcd-cluster-migrator/pkg/project"
+)
+
+const (
+	stateConfigMap = "etcd-cluster-migrator-state"
+	stateKey       = "state.json"
+
+	saveStateTimeout = time.Second * 10
+)
+
+// migrationState is persisted in a ConfigMap so that a migrator which got
+// interrupted or failed leaves a record of where it stopped.
+type migrationState struct {
+	// Phase is the phase the migrator was in last.
+	Phase string `json:"phase"`
+	// Node is the node the last phase was executed for, if any.
+	Node string `json:"node,omitempty"`
+	// Interrupted is true when the migrator stopped because it was
+	// cancelled, e.g. on SIGTERM.
+	Interrupted bool   `json:"interrupted"`
+	Error       string `json:"error,omitempty"`
+	UpdatedAt   string `json:"updatedAt"`
+	// Backups are the etcd backups taken on the nodes which have not been
+	// cleaned up yet.
+	Backups []nodeBackup `json:"backups,omitempty"`
+	// MemberNodes maps the positions of the etcd members which were added,
+	// or are being added, to their nodes, so that they keep their positions
+	// when their nodes become ineligible.
+	MemberNodes map[int]string `json:"memberNodes,omitempty"`
+}
+
+// setMemberNode maps the etcd member at the given position to the given node.
+func (m *Migrator) setMemberNode(position int, nodeName string) {
+	if m.state.MemberNodes == nil {
+		m.state.MemberNodes = map[int]string{}
+	}
+	m.state.MemberNodes[position] = nodeName
+}
+
+// recordMemberNodes maps the positions of the first member and the started
+// members, which are not mapped yet, to the given nodes and persists them.
+// This covers the first member, which was not added by the migrator, and
+// members added by a migrator not recording their nodes.
+func (m *Migrator) recordMemberNodes(ctx context.Context, nodeNames []string, members []*etcdserver.Member) {
+	var changed bool
+	for position, nodeName := range nodeNames {
+		if _, ok := m.state.MemberNodes[position]; ok {
+			continue
+		}
+		member := findMember(members, m.etcdPeerURL(m.etcdStartingIndex+position))
+		if position != 0 && (member == nil || member.Name == "") {
+			continue
+		}
+		m.setMemberNode(position, nodeName)
+		changed = true
+	}
+	if changed {
+		m.persistState(ctx)
+	}
+}
+
+// Phase returns the phase the migrator is in, or stopped in, and the node
+// the phase is executed for, if any.
+func (m *Migrator) Phase() (string, string) {
+	return m.state.Phase, m.state.Node
+}
+
+// enterPhase marks the given phase as active for the given node.
+func (m *Migrator) enterPhase(phase string, node string) {
+	setPhase(phase)
+	m.state.Phase = phase
+	m.state.Node = node
+}
+
+func (m *Migrator) loadState(ctx context.Context) (migrationState, error) {
+	var s migrationState
+
+	cm, err := m.k8sClient.CoreV1().ConfigMaps(m.namespace).Get(ctx, stateConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return s, nil
+	} else if err != nil {
+		return s, microerror.Mask(err)
+	}
+
+	err = json.Unmarshal([]byte(cm.Data[stateKey]), &s)
+	if err != nil {
+		return s, microerror.Mask(err)
+	}
+
+	return s, nil
+}
+
+// saveState persists the current state. It uses its own context so that the
+// state is still written when the migrator is being cancelled.
+func (m *Migrator) saveState(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), saveStateTimeout)
+	defer cancel()
+
+	m.state.UpdatedAt = m.clock.Now().UTC().Format(time.RFC3339)
+	b, err := json.Marshal(m.state)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	cm := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      stateConfigMap,
+			Namespace: m.namespace,
+			Labels: map[string]string{
+				"app":        stateConfigMap,
+				"created-by": project.Name(),
+			},
+		},
+		Data: map[string]string{
+			stateKey: string(b),
+		},
+	}
+
+	_, err = m.k8sClient.CoreV1().ConfigMaps(m.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = m.k8sClient.CoreV1().ConfigMaps(m.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
@@ -1 +1,23 @@
 package migrator
+
+// Status is the state of the etcd cluster as observed by the migrator.
+type Status struct {
+	// MemberCount is the desired number of etcd members.
+	MemberCount int
+	// Members are the current etcd members.
+	Members []MemberStatus
+	// NodeNames are the master nodes ordered by master ID.
+	NodeNames []string
+}
+
+// MemberStatus describes a single etcd member.
+type MemberStatus struct {
+	ID uint64
+	// Name is empty as long as the member has not started.
+	Name string
+	// NodeName is the master node the member is running on, derived from
+	// its peer URL. It is empty if the peer URL is not a planned one.
+	NodeName string
+	PeerURLs []string
+	Started  bool
+}
@@ -0,0 +1,264 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/giantswarm/microerror"
+)
+
+const (
+	etcdVersionMarker = "### etcd-cluster-migrator etcd-version "
+
+	versionSourceImage  = "image"
+	versionSourceBinary = "binary"
+)
+
+var (
+	// etcdImageRegexp matches the tag of an etcd container image in the
+	// etcd3 service file, e.g. quay.io/giantswarm/etcd:v3.4.13.
+	etcdImageRegexp = regexp.MustCompile(`(?:^|\s)(?:\S*/)?etcd[\w.-]*:v?(\d+\.\d+\.\d+)`)
+	// etcdVersionRegexp matches the version in the output of etcd --version
+	// and in the version of the etcd status.
+	etcdVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+)
+
+// etcdVersion is the version of an etcd server.
+type etcdVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v etcdVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// nodeVersion is the etcd version a master node runs.
+type nodeVersion struct {
+	Node    string
+	Version etcdVersion
+	// Source tells whether the version was read from the container image or
+	// the binary of the etcd3 service.
+	Source string
+}
+
+// checkNodeVersions determines the etcd version the etcd3 service of the given
+// nodes runs and compares it with the version of the etcd cluster. A member
+// must run the same major version as the cluster and at most one minor
+// version more, as etcd neither supports downgrades nor skipping a minor
+// version in a rolling upgrade.
+//
+// The etcd3 service file is read through the NodeCommandRunner, so the check
+// is skipped when it can not return the command output.
+func (m *Migrator) checkNodeVersions(ctx context.Context, nodeNames []string) error {
+	if m.skipVersionCheck {
+		return nil
+	}
+
+	runner, ok := m.commandRunner.(NodeCommandOutputRunner)
+	if !ok {
+		m.logger.LogCtx(ctx, "level", "warning", "message", "node command runner does not return output, skipping etcd version check", "step", phaseCheckVersion)
+		return nil
+	}
+
+	s, err := m.clientStatus(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	cluster, err := parseEtcdVersion(s.Version)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	var versions []nodeVersion
+	for _, nodeName := range nodeNames {
+		v, err := m.nodeEtcdVersion(ctx, runner, nodeName)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		versions = append(versions, v)
+	}
+
+	m.logger.LogCtx(ctx, "level", "info", "message", fmt.Sprintf("etcd cluster runs version %s\n%s", cluster, formatNodeVersions(versions)), "step", phaseCheckVersion)
+
+	var failures []string
+	for _, v := range versions {
+		reason, warning := versionSkew(cluster, v.Version)
+		switch {
+		case reason == "":
+		case warning:
+			m.logger.LogCtx(ctx, "level", "warning", "message", reason, "step", phaseCheckVersion, "node", v.Node)
+		default:
+			failures = append(failures, fmt.Sprintf("node %s %s", v.Node, reason))
+		}
+	}
+	if len(failures) > 0 {
+		return microerror.Maskf(preflightFailedError, "etcd version skew to cluster version %s is not supported: %s", cluster, strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// nodeEtcdVersion returns the etcd version of the etcd3 service of the given
+// node, taken from the tag of its container image or, when it runs the etcd
+// binary directly, from the version the binary prints.
+func (m *Migrator) nodeEtcdVersion(ctx context.Context, runner NodeCommandOutputRunner, nodeName string) (nodeVersion, error) {
+	output, err := runner.RunCommandsWithOutput(ctx, nodeName, readFileCommands([]string{etcdServiceFile}))
+	if err != nil {
+		return nodeVersion{}, microerror.Mask(err)
+	}
+	unit := parseNodeFiles(output)[etcdServiceFile]
+	if len(unit) == 0 {
+		return nodeVersion{}, microerror.Maskf(preflightFailedError, "found no %s on node %s", etcdServiceFile, nodeName)
+	}
+
+	if v, ok := imageEtcdVersion(unit); ok {
+		return nodeVersion{Node: nodeName, Version: v, Source: versionSourceImage}, nil
+	}
+
+	binary := etcdBinary(unit)
+	if binary == "" {
+		return nodeVersion{}, microerror.Maskf(preflightFailedError, "found neither an etcd image nor an etcd binary in %s on node %s", etcdServiceFile, nodeName)
+	}
+
+	output, err = runner.RunCommandsWithOutput(ctx, nodeName, binaryVersionCommands(binary))
+	if err != nil {
+		return nodeVersion{}, microerror.Mask(err)
+	}
+	v, err := parseBinaryVersion(output)
+	if err != nil {
+		return nodeVersion{}, microerror.Maskf(preflightFailedError, "failed to read version of %s on node %s: %s", binary, nodeName, err)
+	}
+
+	return nodeVersion{Node: nodeName, Version: v, Source: versionSourceBinary}, nil
+}
+
+// imageEtcdVersion returns the version in the tag of the etcd container image
+// of the given etcd3 service file.
+func imageEtcdVersion(unit []byte) (etcdVersion, bool) {
+	match := etcdImageRegexp.FindSubmatch(unit)
+	if match == nil {
+		return etcdVersion{}, false
+	}
+
+	v, err := parseEtcdVersion(string(match[1]))
+	if err != nil {
+		return etcdVersion{}, false
+	}
+
+	return v, true
+}
+
+// etcdBinary returns the path of the etcd binary executed by the given etcd3
+// service file, or an empty string if it executes something else.
+func etcdBinary(unit []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(unit))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "ExecStart=") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "ExecStart="))
+		if len(fields) == 0 {
+			return ""
+		}
+		// systemd prefixes like - or @ change how the command is executed
+		binary := strings.TrimLeft(fields[0], "-@:+!")
+		if path.Base(binary) != "etcd" {
+			return ""
+		}
+
+		return binary
+	}
+
+	return ""
+}
+
+// binaryVersionCommands returns the command printing the first line of the
+// version output of the given etcd binary after etcdVersionMarker.
+func binaryVersionCommands(binary string) []string {
+	return []string{
+		fmt.Sprintf(`sh -c 'echo "%s$(%s --version 2>/dev/null | head -n 1)"'`, etcdVersionMarker, binary),
+	}
+}
+
+// parseBinaryVersion returns the version printed by binaryVersionCommands.
+func parseBinaryVersion(output []byte) (etcdVersion, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, etcdVersionMarker) {
+			continue
+		}
+
+		v, err := parseEtcdVersion(strings.TrimPrefix(line, etcdVersionMarker))
+		if err != nil {
+			return etcdVersion{}, microerror.Mask(err)
+		}
+
+		return v, nil
+	}
+
+	return etcdVersion{}, microerror.Maskf(executionFailedError, "found no etcd version output")
+}
+
+// parseEtcdVersion returns the first version found in the given string,
+// e.g. 3.4.13 in "etcd Version: 3.4.13".
+func parseEtcdVersion(s string) (etcdVersion, error) {
+	match := etcdVersionRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return etcdVersion{}, microerror.Maskf(executionFailedError, "found no etcd version in %q", s)
+	}
+
+	var parts [3]int
+	for i := range parts {
+		n, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return etcdVersion{}, microerror.Mask(err)
+		}
+		parts[i] = n
+	}
+
+	return etcdVersion{Major: parts[0], Minor: parts[1], Patch: parts[2]}, nil
+}
+
+// versionSkew returns why a member of the given node version may not join a
+// cluster of the given version, or an empty string if it may. A reason which
+// is only a warning is flagged as such.
+func versionSkew(cluster etcdVersion, node etcdVersion) (string, bool) {
+	switch {
+	case node.Major != cluster.Major:
+		return fmt.Sprintf("runs major version %d", node.Major), false
+	case node.Minor < cluster.Minor:
+		return fmt.Sprintf("runs older minor version %s", node), false
+	case node.Minor > cluster.Minor+1:
+		return fmt.Sprintf("runs version %s, more than one minor version ahead", node), false
+	case node.Minor == cluster.Minor+1:
+		return fmt.Sprintf("etcd version %s is one minor version ahead of cluster version %s, the cluster keeps running as %d.%d until all members are upgraded", node, cluster, cluster.Major, cluster.Minor), true
+	}
+
+	return "", false
+}
+
+// formatNodeVersions returns a table of the given node versions.
+func formatNodeVersions(versions []nodeVersion) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "NODE\tETCD VERSION\tSOURCE")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Node, v.Version, v.Source)
+	}
+	w.Flush()
+
+	return b.String()
+}
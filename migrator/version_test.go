@@ -0,0 +1,178 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	etcdclientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const testImageUnit = `[Unit]
+Description=etcd3
+
+[Service]
+ExecStart=/usr/bin/docker run \
+  --name etcd3 \
+  quay.io/giantswarm/etcd:v3.4.13 \
+  etcd \
+  --name etcd1 \
+  --initial-advertise-peer-urls=https://etcd1.cluster.test:2380 \
+  --initial-cluster etcd1=https://etcd1.cluster.test:2380\
+`
+
+const testBinaryUnit = `[Unit]
+Description=etcd3
+
+[Service]
+ExecStart=/opt/bin/etcd \
+  --name etcd1 \
+  --initial-cluster etcd1=https://etcd1.cluster.test:2380\
+`
+
+func Test_Migrator_checkNodeVersions(t *testing.T) {
+	testCases := []struct {
+		name         string
+		cluster      string
+		units        map[string]string
+		binary       string
+		errorMatcher func(error) bool
+	}{
+		{
+			name:    "case 0: same minor version from image",
+			cluster: "3.4.3",
+			units:   map[string]string{"master-2": testImageUnit, "master-3": testImageUnit},
+		},
+		{
+			name:    "case 1: one minor version ahead from binary",
+			cluster: "3.3.15",
+			units:   map[string]string{"master-2": testImageUnit, "master-3": testBinaryUnit},
+			binary:  "etcd Version: 3.4.13\nGit SHA: ae9734ed2\n",
+		},
+		{
+			name:         "case 2: older minor version",
+			cluster:      "3.5.10",
+			units:        map[string]string{"master-2": testImageUnit, "master-3": testImageUnit},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 3: two minor versions ahead",
+			cluster:      "3.2.26",
+			units:        map[string]string{"master-2": testImageUnit, "master-3": testImageUnit},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 4: missing service file",
+			cluster:      "3.4.13",
+			units:        map[string]string{"master-2": testImageUnit},
+			errorMatcher: IsPreflightFailed,
+		},
+		{
+			name:         "case 5: binary prints no version",
+			cluster:      "3.4.13",
+			units:        map[string]string{"master-2": testImageUnit, "master-3": testBinaryUnit},
+			errorMatcher: IsPreflightFailed,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			status := testStatus(1, 1, 1)
+			status.Version = tc.cluster
+
+			r := &testVersionRunner{
+				units:  tc.units,
+				binary: tc.binary,
+			}
+			m := &Migrator{
+				commandRunner: r,
+				etcdClient: &testEndpointsClient{
+					EtcdClient: &testStatusClient{statuses: map[string]*etcdclientv3.StatusResponse{"127.0.0.1:2379": status}},
+					endpoints:  []string{"127.0.0.1:2379"},
+				},
+				logger: microloggertest.New(),
+			}
+
+			err := m.checkNodeVersions(context.Background(), []string{"master-2", "master-3"})
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("%s: error == %#v, want nil", tc.name, err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("%s: error == nil, want non-nil", tc.name)
+			case !tc.errorMatcher(err):
+				t.Fatalf("%s: error == %#v, want matching", tc.name, err)
+			}
+		})
+	}
+}
+
+func Test_imageEtcdVersion(t *testing.T) {
+	v, ok := imageEtcdVersion([]byte(testImageUnit))
+	if !ok || v != (etcdVersion{Major: 3, Minor: 4, Patch: 13}) {
+		t.Fatalf("version == %s, want 3.4.13", v)
+	}
+
+	// the peer URLs of the etcd hosts are no image
+	_, ok = imageEtcdVersion([]byte(testBinaryUnit))
+	if ok {
+		t.Fatalf("expected no image version in binary unit")
+	}
+
+	if b := etcdBinary([]byte(testBinaryUnit)); b != "/opt/bin/etcd" {
+		t.Fatalf("binary == %q, want /opt/bin/etcd", b)
+	}
+	if b := etcdBinary([]byte(testImageUnit)); b != "" {
+		t.Fatalf("binary == %q, want empty", b)
+	}
+}
+
+func Test_versionSkew(t *testing.T) {
+	testCases := []struct {
+		cluster string
+		node    string
+		failed  bool
+		warning bool
+	}{
+		{cluster: "3.4.3", node: "3.4.13"},
+		{cluster: "3.4.13", node: "3.4.3"},
+		{cluster: "3.4.13", node: "3.5.10", warning: true},
+		{cluster: "3.4.13", node: "3.3.15", failed: true},
+		{cluster: "3.3.15", node: "3.5.10", failed: true},
+		{cluster: "3.4.13", node: "2.4.13", failed: true},
+	}
+
+	for _, tc := range testCases {
+		cluster, _ := parseEtcdVersion(tc.cluster)
+		node, _ := parseEtcdVersion(tc.node)
+
+		reason, warning := versionSkew(cluster, node)
+		if failed := reason != "" && !warning; failed != tc.failed || warning != tc.warning {
+			t.Fatalf("node %s joining cluster %s: reason == %q, warning == %t", tc.node, tc.cluster, reason, warning)
+		}
+	}
+}
+
+// testVersionRunner prints the etcd3 service file of the node and the given
+// output of etcd --version.
+type testVersionRunner struct {
+	units  map[string]string
+	binary string
+}
+
+func (r *testVersionRunner) RunCommands(ctx context.Context, nodeName string, commands []string) error {
+	return nil
+}
+
+func (r *testVersionRunner) RunCommandsWithOutput(ctx context.Context, nodeName string, commands []string) ([]byte, error) {
+	if strings.Contains(strings.Join(commands, "\n"), "--version") {
+		line, _, _ := strings.Cut(r.binary, "\n")
+		return []byte(fmt.Sprintf("%s%s\n", etcdVersionMarker, line)), nil
+	}
+
+	return []byte(fmt.Sprintf("%s%s\n%s\n%s\n", nodeFileBeginMarker, etcdServiceFile, r.units[nodeName], nodeFileEndMarker)), nil
+}
@@ -0,0 +1,98 @@
+package migrator
+
+import (
+	"context"
+	"time"
+
+	cenkaltibackoff "github.com/cenkalti/backoff/v4"
+	"github.com/giantswarm/backoff"
+	"github.com/giantswarm/microerror"
+	"k8s.io/utils/clock"
+)
+
+// intervals are the durations the migrator waits for. NewMigrator sets the
+// defaults, tests shorten them.
+type intervals struct {
+	// apiRetry is the interval in which the Kubernetes API is checked
+	// after a member was added.
+	apiRetry time.Duration
+	// apiStart is the time given to the etcd data sync before the
+	// Kubernetes API is checked.
+	apiStart time.Duration
+	// lockLease is the duration of the migration lock lease.
+	lockLease time.Duration
+	// lockRenew is the interval in which the migration lock is renewed.
+	lockRenew time.Duration
+	// masterNodeFetch is the interval in which the master nodes are listed
+	// until there are enough eligible ones.
+	masterNodeFetch time.Duration
+	// memberAddRetry is the interval in which adding a member is retried
+	// while the etcd cluster is not healthy.
+	memberAddRetry time.Duration
+	// memberStart is the interval in which the etcd cluster is checked for
+	// a new member to be started or for its quorum to be back.
+	memberStart time.Duration
+}
+
+func defaultIntervals() intervals {
+	return intervals{
+		apiRetry:        time.Second * 5,
+		apiStart:        time.Second * 30,
+		lockLease:       time.Second * 60,
+		lockRenew:       time.Second * 15,
+		masterNodeFetch: time.Second * 10,
+		memberAddRetry:  time.Second * 5,
+		memberStart:     time.Second * 5,
+	}
+}
+
+// sleep waits for the given duration or until the context is cancelled, in
+// which case the context error is returned.
+func sleep(ctx context.Context, c clock.Clock, d time.Duration) error {
+	t := c.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return microerror.Mask(ctx.Err())
+	case <-t.C():
+		return nil
+	}
+}
+
+// withContext stops the given backoff from retrying once the context is
+// cancelled.
+func withContext(ctx context.Context, b backoff.BackOff) backoff.BackOff {
+	return cenkaltibackoff.WithContext(b, ctx)
+}
+
+// retry retries the given operation like backoff.Retry, but waits between
+// the attempts on the given clock.
+func retry(c clock.Clock, o backoff.Operation, b backoff.BackOff) error {
+	err := cenkaltibackoff.RetryNotifyWithTimer(cenkaltibackoff.Operation(o), b, nil, &clockTimer{clock: c})
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// clockTimer is a backoff timer on a clock.
+type clockTimer struct {
+	clock clock.Clock
+	timer clock.Timer
+}
+
+func (t *clockTimer) Start(d time.Duration) {
+	t.timer = t.clock.NewTimer(d)
+}
+
+func (t *clockTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.timer.C()
+}
@@ -0,0 +1,70 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/backoff"
+	"github.com/giantswarm/microerror"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_sleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	err := sleep(ctx, clock.RealClock{}, time.Hour)
+	if !errors.Is(microerror.Cause(err), context.Canceled) {
+		t.Fatalf("expected %#v got %#v", context.Canceled, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected sleep to return immediately after cancellation")
+	}
+
+	err = sleep(context.Background(), clock.RealClock{}, time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected nil got %#v", err)
+	}
+}
+
+func Test_retry(t *testing.T) {
+	clk := clocktesting.NewFakeClock(time.Now())
+
+	var attempts int
+	o := func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- retry(clk, o, backoff.NewMaxRetries(5, time.Hour))
+	}()
+
+	// every retry waits an hour on the fake clock only
+	for i := 0; i < 2; i++ {
+		for !clk.HasWaiters() {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Step(time.Hour)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected nil got %#v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("expected retry to return after stepping the clock")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts got %d", attempts)
+	}
+}
@@ -0,0 +1,111 @@
+// Package logger creates the micrologger.Logger used by the migrator in the
+// configured output format.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
+	"github.com/giantswarm/micrologger/loggermeta"
+	kitlog "github.com/go-kit/log"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+type Config struct {
+	// Format is the log output format, either FormatJSON or FormatText.
+	Format string
+	// IOWriter is where the log lines are written to. Defaults to stdout.
+	IOWriter io.Writer
+}
+
+// New returns a micrologger.Logger writing JSON or logfmt encoded lines
+// depending on the configured format.
+func New(config Config) (micrologger.Logger, error) {
+	if config.IOWriter == nil {
+		config.IOWriter = os.Stdout
+	}
+
+	switch config.Format {
+	case FormatJSON, "":
+		l, err := micrologger.New(micrologger.Config{IOWriter: config.IOWriter})
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		return l, nil
+	case FormatText:
+		kitLogger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(config.IOWriter))
+		kitLogger = kitlog.With(
+			kitLogger,
+			"time", micrologger.DefaultTimestampFormatter,
+		)
+		return &textLogger{logger: kitLogger}, nil
+	default:
+		return nil, microerror.Maskf(invalidConfigError, "%T.Format must be one of %q or %q, got %q", config, FormatJSON, FormatText, config.Format)
+	}
+}
+
+// textLogger implements micrologger.Logger on top of a logfmt encoder, as
+// micrologger itself only supports JSON output.
+type textLogger struct {
+	logger kitlog.Logger
+}
+
+func (l *textLogger) Debug(ctx context.Context, message string) {
+	l.LogCtx(ctx, "level", "debug", "message", message)
+}
+
+func (l *textLogger) Debugf(ctx context.Context, format string, params ...interface{}) {
+	l.Debug(ctx, fmt.Sprintf(format, params...))
+}
+
+func (l *textLogger) Error(ctx context.Context, err error, message string) {
+	if err != nil {
+		l.LogCtx(ctx, "level", "error", "message", message, "stack", microerror.JSON(err))
+	} else {
+		l.LogCtx(ctx, "level", "error", "message", message)
+	}
+}
+
+func (l *textLogger) Errorf(ctx context.Context, err error, format string, params ...interface{}) {
+	l.Error(ctx, err, fmt.Sprintf(format, params...))
+}
+
+func (l *textLogger) Log(keyVals ...interface{}) {
+	l.log(keyVals)
+}
+
+func (l *textLogger) LogCtx(ctx context.Context, keyVals ...interface{}) {
+	meta, ok := loggermeta.FromContext(ctx)
+	if ok {
+		keyVals = append([]interface{}{}, keyVals...)
+		for k, v := range meta.KeyVals {
+			keyVals = append(keyVals, k, v)
+		}
+	}
+
+	l.log(keyVals)
+}
+
+func (l *textLogger) With(keyVals ...interface{}) micrologger.Logger {
+	return &textLogger{logger: kitlog.With(l.logger, keyVals...)}
+}
+
+func (l *textLogger) WithIncreasedCallerDepth() micrologger.Logger {
+	return l
+}
+
+func (l *textLogger) log(keyVals []interface{}) {
+	err := l.logger.Log(keyVals...)
+	if err != nil {
+		log.Printf("failed to log with error: %#q, keyVals = %v", err.Error(), keyVals)
+	}
+}